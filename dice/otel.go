@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	"go.opentelemetry.io/contrib/propagators/autoprop"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
@@ -63,18 +67,42 @@ func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	return
 }
 
+// newPropagator reads OTEL_PROPAGATORS, e.g. "tracecontext,baggage,b3",
+// defaulting to the W3C formats.
 func newPropagator() propagation.TextMapPropagator {
-	return propagation.NewCompositeTextMapPropagator(
-		propagation.TraceContext{},
-		propagation.Baggage{},
-	)
+	return autoprop.NewTextMapPropagator()
+}
+
+// otlpProtocol returns the OTLP protocol from OTEL_EXPORTER_OTLP_PROTOCOL.
+// The exporters pick up the rest of their config from the env themselves.
+func otlpProtocol() (string, error) {
+	switch protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol {
+	case "", "http/protobuf":
+		return "http/protobuf", nil
+	case "http/json", "grpc":
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q", protocol)
+	}
 }
 
 func newTraceProvider(ctx context.Context) (*trace.TracerProvider, error) {
 	var traceExporter trace.SpanExporter
 	var err error
 	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
-		traceExporter, err = otlptracehttp.New(ctx)
+		var protocol string
+		protocol, err = otlpProtocol()
+		if err != nil {
+			return nil, err
+		}
+		switch protocol {
+		case "grpc":
+			traceExporter, err = otlptracegrpc.New(ctx)
+		case "http/json":
+			traceExporter, err = newJSONTraceExporter(ctx)
+		default:
+			traceExporter, err = otlptracehttp.New(ctx)
+		}
 	} else {
 		traceExporter, err = stdouttrace.New(
 			stdouttrace.WithPrettyPrint())
@@ -94,7 +122,19 @@ func newMeterProvider(ctx context.Context) (*metric.MeterProvider, error) {
 	var metricExporter metric.Exporter
 	var err error
 	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""  {
-		metricExporter, err = otlpmetrichttp.New(ctx)
+		var protocol string
+		protocol, err = otlpProtocol()
+		if err != nil {
+			return nil, err
+		}
+		switch protocol {
+		case "grpc":
+			metricExporter, err = otlpmetricgrpc.New(ctx)
+		case "http/json":
+			metricExporter = newJSONMetricExporter()
+		default:
+			metricExporter, err = otlpmetrichttp.New(ctx)
+		}
 	} else {
 		metricExporter, err = stdoutmetric.New()
 	}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The Go OTLP exporters only send protobuf, so for http/json, the SDK's
+// telemetry is put into the OTLP protobuf messages here, and those are sent
+// as JSON. Like the other exporters, they're configured from the
+// OTEL_EXPORTER_OTLP_* endpoint, headers and compression env vars.
+
+// jsonClient sends OTLP requests as JSON to the endpoint of one signal.
+type jsonClient struct {
+	url     string
+	headers map[string]string
+	gzip    bool
+	client  *http.Client
+}
+
+// newJSONClient returns a client for signal, "traces" or "metrics".
+func newJSONClient(signal string) *jsonClient {
+	c := &jsonClient{
+		url:     os.Getenv("OTEL_EXPORTER_OTLP_" + strings.ToUpper(signal) + "_ENDPOINT"),
+		headers: map[string]string{},
+		gzip:    os.Getenv("OTEL_EXPORTER_OTLP_COMPRESSION") == "gzip",
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if c.url == "" {
+		c.url = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if u, err := url.Parse(c.url); err == nil {
+			u.Path = path.Join("/", u.Path, "v1", signal)
+			c.url = u.String()
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if v, err := url.PathUnescape(v); err == nil {
+			c.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return c
+}
+
+func (c *jsonClient) send(ctx context.Context, req proto.Message) error {
+	body, err := marshalOTLPJSON(req)
+	if err != nil {
+		return err
+	}
+	if c.gzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.headers {
+		r.Header.Set(k, v)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if c.gzip {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read it, so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to send to %s: %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// otlpIDKeys are the fields with trace and span ids, which OTLP/JSON has
+// as hex, rather than the base64 that protojson gives bytes fields.
+var otlpIDKeys = map[string]bool{"traceId": true, "spanId": true, "parentSpanId": true}
+
+// marshalOTLPJSON marshals an OTLP request as OTLP/JSON: protojson, with
+// enums as numbers, and ids as hex.
+func marshalOTLPJSON(m proto.Message) ([]byte, error) {
+	data, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Leave the numbers as they are
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	hexIDs(v)
+	return json.Marshal(v)
+}
+
+func hexIDs(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if s, ok := e.(string); ok && otlpIDKeys[k] {
+				if id, err := base64.StdEncoding.DecodeString(s); err == nil {
+					v[k] = hex.EncodeToString(id)
+				}
+				continue
+			}
+			hexIDs(e)
+		}
+	case []any:
+		for _, e := range v {
+			hexIDs(e)
+		}
+	}
+}
+
+// jsonTraceClient is an otlptrace.Client, for the exporter that puts the
+// spans into messages.
+type jsonTraceClient struct {
+	*jsonClient
+}
+
+func newJSONTraceExporter(ctx context.Context) (*otlptrace.Exporter, error) {
+	return otlptrace.New(ctx, jsonTraceClient{newJSONClient("traces")})
+}
+
+func (jsonTraceClient) Start(context.Context) error {
+	return nil
+}
+
+func (c jsonTraceClient) Stop(context.Context) error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+func (c jsonTraceClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	return c.send(ctx, &coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+}
+
+// jsonMetricExporter is a metric.Exporter for http/json, with the same
+// defaults as the other exporters.
+type jsonMetricExporter struct {
+	*jsonClient
+}
+
+func newJSONMetricExporter() jsonMetricExporter {
+	return jsonMetricExporter{newJSONClient("metrics")}
+}
+
+func (jsonMetricExporter) Temporality(kind metric.InstrumentKind) metricdata.Temporality {
+	return metric.DefaultTemporalitySelector(kind)
+}
+
+func (jsonMetricExporter) Aggregation(kind metric.InstrumentKind) metric.Aggregation {
+	return metric.DefaultAggregationSelector(kind)
+}
+
+func (e jsonMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	return e.send(ctx, &colmetricpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricpb.ResourceMetrics{pbResourceMetrics(rm)},
+	})
+}
+
+func (jsonMetricExporter) ForceFlush(context.Context) error {
+	return nil
+}
+
+func (e jsonMetricExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+func pbResource(res *resource.Resource) *resourcepb.Resource {
+	return &resourcepb.Resource{Attributes: pbAttributes(res.Attributes())}
+}
+
+func pbScope(scope instrumentation.Scope) *commonpb.InstrumentationScope {
+	return &commonpb.InstrumentationScope{Name: scope.Name, Version: scope.Version}
+}
+
+func pbAttributes(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		kvs = append(kvs, &commonpb.KeyValue{Key: string(kv.Key), Value: pbValue(kv.Value)})
+	}
+	return kvs
+}
+
+func pbValue(v attribute.Value) *commonpb.AnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.AsBool()}}
+	case attribute.INT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.AsInt64()}}
+	case attribute.FLOAT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.AsFloat64()}}
+	case attribute.STRING:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.AsString()}}
+	case attribute.BOOLSLICE:
+		return pbArray(v.AsBoolSlice(), attribute.BoolValue)
+	case attribute.INT64SLICE:
+		return pbArray(v.AsInt64Slice(), attribute.Int64Value)
+	case attribute.FLOAT64SLICE:
+		return pbArray(v.AsFloat64Slice(), attribute.Float64Value)
+	case attribute.STRINGSLICE:
+		return pbArray(v.AsStringSlice(), attribute.StringValue)
+	}
+	return &commonpb.AnyValue{}
+}
+
+func pbArray[T any](values []T, value func(T) attribute.Value) *commonpb.AnyValue {
+	array := &commonpb.ArrayValue{Values: make([]*commonpb.AnyValue, 0, len(values))}
+	for _, v := range values {
+		array.Values = append(array.Values, pbValue(value(v)))
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: array}}
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func pbResourceMetrics(rm *metricdata.ResourceMetrics) *metricpb.ResourceMetrics {
+	out := &metricpb.ResourceMetrics{
+		Resource:  pbResource(rm.Resource),
+		SchemaUrl: rm.Resource.SchemaURL(),
+	}
+	for _, sm := range rm.ScopeMetrics {
+		scope := &metricpb.ScopeMetrics{Scope: pbScope(sm.Scope), SchemaUrl: sm.Scope.SchemaURL}
+		for _, m := range sm.Metrics {
+			if pm := pbMetric(m); pm != nil {
+				scope.Metrics = append(scope.Metrics, pm)
+			}
+		}
+		out.ScopeMetrics = append(out.ScopeMetrics, scope)
+	}
+	return out
+}
+
+// pbMetric returns nil for an aggregation OTLP doesn't have.
+func pbMetric(m metricdata.Metrics) *metricpb.Metric {
+	pm := &metricpb.Metric{Name: m.Name, Description: m.Description, Unit: m.Unit}
+	switch a := m.Data.(type) {
+	case metricdata.Gauge[int64]:
+		pm.Data = &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: pbNumberPoints(a.DataPoints)}}
+	case metricdata.Gauge[float64]:
+		pm.Data = &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: pbNumberPoints(a.DataPoints)}}
+	case metricdata.Sum[int64]:
+		pm.Data = &metricpb.Metric_Sum{Sum: pbSum(a)}
+	case metricdata.Sum[float64]:
+		pm.Data = &metricpb.Metric_Sum{Sum: pbSum(a)}
+	case metricdata.Histogram[int64]:
+		pm.Data = &metricpb.Metric_Histogram{Histogram: pbHistogram(a)}
+	case metricdata.Histogram[float64]:
+		pm.Data = &metricpb.Metric_Histogram{Histogram: pbHistogram(a)}
+	case metricdata.ExponentialHistogram[int64]:
+		pm.Data = &metricpb.Metric_ExponentialHistogram{ExponentialHistogram: pbExponentialHistogram(a)}
+	case metricdata.ExponentialHistogram[float64]:
+		pm.Data = &metricpb.Metric_ExponentialHistogram{ExponentialHistogram: pbExponentialHistogram(a)}
+	case metricdata.Summary:
+		pm.Data = &metricpb.Metric_Summary{Summary: pbSummary(a)}
+	default:
+		return nil
+	}
+	return pm
+}
+
+func pbTemporality(t metricdata.Temporality) metricpb.AggregationTemporality {
+	switch t {
+	case metricdata.CumulativeTemporality:
+		return metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	case metricdata.DeltaTemporality:
+		return metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	}
+	return metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED
+}
+
+func pbNumberPoints[N int64 | float64](points []metricdata.DataPoint[N]) []*metricpb.NumberDataPoint {
+	out := make([]*metricpb.NumberDataPoint, 0, len(points))
+	for _, p := range points {
+		np := &metricpb.NumberDataPoint{
+			Attributes:        pbAttributes(p.Attributes.ToSlice()),
+			StartTimeUnixNano: unixNano(p.StartTime),
+			TimeUnixNano:      unixNano(p.Time),
+			Exemplars:         pbExemplars(p.Exemplars),
+		}
+		switch v := any(p.Value).(type) {
+		case int64:
+			np.Value = &metricpb.NumberDataPoint_AsInt{AsInt: v}
+		case float64:
+			np.Value = &metricpb.NumberDataPoint_AsDouble{AsDouble: v}
+		}
+		out = append(out, np)
+	}
+	return out
+}
+
+func pbSum[N int64 | float64](s metricdata.Sum[N]) *metricpb.Sum {
+	return &metricpb.Sum{
+		AggregationTemporality: pbTemporality(s.Temporality),
+		IsMonotonic:            s.IsMonotonic,
+		DataPoints:             pbNumberPoints(s.DataPoints),
+	}
+}
+
+func pbHistogram[N int64 | float64](h metricdata.Histogram[N]) *metricpb.Histogram {
+	out := &metricpb.Histogram{AggregationTemporality: pbTemporality(h.Temporality)}
+	for _, p := range h.DataPoints {
+		sum := float64(p.Sum)
+		out.DataPoints = append(out.DataPoints, &metricpb.HistogramDataPoint{
+			Attributes:        pbAttributes(p.Attributes.ToSlice()),
+			StartTimeUnixNano: unixNano(p.StartTime),
+			TimeUnixNano:      unixNano(p.Time),
+			Count:             p.Count,
+			Sum:               &sum,
+			BucketCounts:      p.BucketCounts,
+			ExplicitBounds:    p.Bounds,
+			Exemplars:         pbExemplars(p.Exemplars),
+			Min:               pbExtrema(p.Min),
+			Max:               pbExtrema(p.Max),
+		})
+	}
+	return out
+}
+
+func pbExponentialHistogram[N int64 | float64](h metricdata.ExponentialHistogram[N]) *metricpb.ExponentialHistogram {
+	out := &metricpb.ExponentialHistogram{AggregationTemporality: pbTemporality(h.Temporality)}
+	for _, p := range h.DataPoints {
+		sum := float64(p.Sum)
+		out.DataPoints = append(out.DataPoints, &metricpb.ExponentialHistogramDataPoint{
+			Attributes:        pbAttributes(p.Attributes.ToSlice()),
+			StartTimeUnixNano: unixNano(p.StartTime),
+			TimeUnixNano:      unixNano(p.Time),
+			Count:             p.Count,
+			Sum:               &sum,
+			Scale:             p.Scale,
+			ZeroCount:         p.ZeroCount,
+			ZeroThreshold:     p.ZeroThreshold,
+			Positive: &metricpb.ExponentialHistogramDataPoint_Buckets{
+				Offset:       p.PositiveBucket.Offset,
+				BucketCounts: p.PositiveBucket.Counts,
+			},
+			Negative: &metricpb.ExponentialHistogramDataPoint_Buckets{
+				Offset:       p.NegativeBucket.Offset,
+				BucketCounts: p.NegativeBucket.Counts,
+			},
+			Exemplars: pbExemplars(p.Exemplars),
+			Min:       pbExtrema(p.Min),
+			Max:       pbExtrema(p.Max),
+		})
+	}
+	return out
+}
+
+func pbExtrema[N int64 | float64](e metricdata.Extrema[N]) *float64 {
+	v, ok := e.Value()
+	if !ok {
+		return nil
+	}
+	f := float64(v)
+	return &f
+}
+
+func pbSummary(s metricdata.Summary) *metricpb.Summary {
+	out := &metricpb.Summary{}
+	for _, p := range s.DataPoints {
+		dp := &metricpb.SummaryDataPoint{
+			Attributes:        pbAttributes(p.Attributes.ToSlice()),
+			StartTimeUnixNano: unixNano(p.StartTime),
+			TimeUnixNano:      unixNano(p.Time),
+			Count:             p.Count,
+			Sum:               p.Sum,
+		}
+		for _, q := range p.QuantileValues {
+			dp.QuantileValues = append(dp.QuantileValues, &metricpb.SummaryDataPoint_ValueAtQuantile{
+				Quantile: q.Quantile,
+				Value:    q.Value,
+			})
+		}
+		out.DataPoints = append(out.DataPoints, dp)
+	}
+	return out
+}
+
+func pbExemplars[N int64 | float64](exemplars []metricdata.Exemplar[N]) []*metricpb.Exemplar {
+	if len(exemplars) == 0 {
+		return nil
+	}
+	out := make([]*metricpb.Exemplar, 0, len(exemplars))
+	for _, e := range exemplars {
+		pe := &metricpb.Exemplar{
+			FilteredAttributes: pbAttributes(e.FilteredAttributes),
+			TimeUnixNano:       unixNano(e.Time),
+			SpanId:             e.SpanID,
+			TraceId:            e.TraceID,
+		}
+		switch v := any(e.Value).(type) {
+		case int64:
+			pe.Value = &metricpb.Exemplar_AsInt{AsInt: v}
+		case float64:
+			pe.Value = &metricpb.Exemplar_AsDouble{AsDouble: v}
+		}
+		out = append(out, pe)
+	}
+	return out
+}
@@ -0,0 +1,158 @@
+package kongotel
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The consumer fields that consumer_baggage can pass on.
+const (
+	consumerFieldID           = "consumer.id"
+	consumerFieldUsername     = "consumer.username"
+	consumerFieldCustomID     = "consumer.custom_id"
+	consumerFieldCredentialID = "credential.id"
+)
+
+func validateConsumerBaggage(fields map[string]string) error {
+	for key, field := range fields {
+		switch field {
+		case consumerFieldID, consumerFieldUsername, consumerFieldCustomID, consumerFieldCredentialID:
+		default:
+			return fmt.Errorf("consumer_baggage %q: unknown field %q", key, field)
+		}
+		// The W3C format is stricter about keys than the API
+		if _, err := baggage.NewMember(key, ""); err != nil {
+			return fmt.Errorf("consumer_baggage: %w", err)
+		}
+	}
+	return nil
+}
+
+// promotedBaggage are the members of the baggage of ctx that keys name, as
+// attributes of the same names.
+func promotedBaggage(ctx context.Context, keys []string) []attribute.KeyValue {
+	if len(keys) == 0 {
+		return nil
+	}
+	bag := baggage.FromContext(ctx)
+	var attrs []attribute.KeyValue
+	for _, key := range keys {
+		if m := bag.Member(key); m.Key() != "" {
+			attrs = append(attrs, attribute.String(key, m.Value()))
+		}
+	}
+	return attrs
+}
+
+// maxBaggageValues bounds how many values of each promoted member are
+// recorded on the metrics. Baggage is whatever clients send, and each
+// value is another metric series.
+const maxBaggageValues = 100
+
+// baggageOverflow is recorded on the metrics instead of values beyond
+// maxBaggageValues, as with the semantic conventions' error.type.
+const baggageOverflow = "_OTHER"
+
+// baggageValues keeps the promoted baggage on the metrics to the first
+// maxBaggageValues values seen of each member. The spans have them all.
+type baggageValues struct {
+	mu   sync.Mutex
+	seen map[attribute.Key]map[string]struct{}
+}
+
+func newBaggageValues() *baggageValues {
+	return &baggageValues{seen: map[attribute.Key]map[string]struct{}{}}
+}
+
+// bound returns promoted with the values that don't fit replaced by
+// baggageOverflow.
+func (b *baggageValues) bound(promoted []attribute.KeyValue) []attribute.KeyValue {
+	if len(promoted) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bounded := make([]attribute.KeyValue, 0, len(promoted))
+	for _, kv := range promoted {
+		seen, ok := b.seen[kv.Key]
+		if !ok {
+			seen = map[string]struct{}{}
+			b.seen[kv.Key] = seen
+		}
+		value := kv.Value.AsString()
+		if _, ok := seen[value]; !ok {
+			if len(seen) >= maxBaggageValues {
+				value = baggageOverflow
+			} else {
+				seen[value] = struct{}{}
+			}
+		}
+		bounded = append(bounded, kv.Key.String(value))
+	}
+	return bounded
+}
+
+// addConsumerBaggage adds the consumer that Kong authenticated to the
+// baggage of ctx, with the members that consumerBaggage maps to its
+// fields, so that the upstream gets them.
+// Auth plugins run before ours, so the consumer is known by the access
+// phase. A failure is recorded on the span of ctx, and ctx returned as it
+// was.
+func (o requestOptions) addConsumerBaggage(ctx context.Context, kong *pdk.PDK) (context.Context, error) {
+	if len(o.consumerBaggage) == 0 {
+		return ctx, nil
+	}
+	values := map[string]string{}
+	for _, field := range o.consumerBaggage {
+		if _, ok := values[field]; ok {
+			continue
+		}
+		switch field {
+		case consumerFieldID, consumerFieldUsername, consumerFieldCustomID:
+			consumer, err := kong.Client.GetConsumer()
+			if err != nil {
+				RecordPDKError(trace.SpanFromContext(ctx), "kong.client.get_consumer", err)
+				return ctx, err
+			}
+			values[consumerFieldID] = consumer.Id
+			values[consumerFieldUsername] = consumer.Username
+			values[consumerFieldCustomID] = consumer.CustomId
+		case consumerFieldCredentialID:
+			credential, err := kong.Client.GetCredential()
+			if err != nil {
+				RecordPDKError(trace.SpanFromContext(ctx), "kong.client.get_credential", err)
+				return ctx, err
+			}
+			values[consumerFieldCredentialID] = credential.Id
+		}
+	}
+
+	bag := baggage.FromContext(ctx)
+	keys := make([]string, 0, len(o.consumerBaggage))
+	for key := range o.consumerBaggage {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := values[o.consumerBaggage[key]]
+		if value == "" {
+			// Anonymous, or no such field
+			continue
+		}
+		member, err := baggage.NewMemberRaw(key, value)
+		if err != nil {
+			return ctx, err
+		}
+		if bag, err = bag.SetMember(member); err != nil {
+			return ctx, err
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, bag), nil
+}
@@ -0,0 +1,94 @@
+package kongotel
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestBaggage(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	reader := setupMetrics(t)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+		Headers: map[string][]string{
+			"baggage": {"tenant.id=acme,session=123"},
+		},
+	})
+	chk.NoError(err)
+
+	New := NewPlugin(context.Background(), nil, func() interface{} { return &helloPlugin{} })
+	conf := New().(*plugin)
+	chk.NoError(conf.UnmarshalJSON([]byte(`{"otel": {
+		"baggage_attributes": ["tenant.id", "user.name", "user.tier"],
+		"consumer_baggage": {"user.name": "consumer.username", "user.credential": "credential.id"}
+	}}`)))
+	env.DoHttp(conf)
+
+	promoted := []attribute.KeyValue{
+		attribute.String("tenant.id", "acme"),
+		attribute.String("user.name", "Jon Doe"),
+	}
+	if chk.Len(*exporter.spans, 5) {
+		serverSpan := (*exporter.spans)[4]
+		chk.Subset(serverSpan.Attributes(), promoted)
+		chk.NotContains(serverSpan.Attributes(), attribute.String("session", "123"), "not promoted")
+	}
+
+	if duration, ok := collect(t, reader)["http.server.request.duration"].(metricdata.Histogram[float64]); chk.True(ok) {
+		for _, kv := range promoted {
+			chk.True(duration.DataPoints[0].Attributes.HasValue(kv.Key))
+		}
+	}
+
+	upstream, err := baggage.Parse(env.ServiceReq.Headers.Get("baggage"))
+	chk.NoError(err)
+	chk.Equal("acme", upstream.Member("tenant.id").Value())
+	chk.Equal("123", upstream.Member("session").Value())
+	chk.Equal("Jon Doe", upstream.Member("user.name").Value())
+	chk.Equal("000:00", upstream.Member("user.credential").Value())
+}
+
+func TestBaggageValues(t *testing.T) {
+	chk := assert.New(t)
+	b := newBaggageValues()
+	for i := 0; i < maxBaggageValues; i++ {
+		tenant := attribute.String("tenant.id", fmt.Sprint("tenant-", i))
+		chk.Equal([]attribute.KeyValue{tenant}, b.bound([]attribute.KeyValue{tenant}))
+	}
+
+	chk.Equal([]attribute.KeyValue{
+		attribute.String("tenant.id", baggageOverflow),
+		attribute.String("user.tier", "gold"),
+	}, b.bound([]attribute.KeyValue{
+		attribute.String("tenant.id", "one too many"),
+		attribute.String("user.tier", "gold"),
+	}))
+	chk.Equal([]attribute.KeyValue{attribute.String("tenant.id", "tenant-0")},
+		b.bound([]attribute.KeyValue{attribute.String("tenant.id", "tenant-0")}), "seen already")
+}
+
+func TestValidateConsumerBaggage(t *testing.T) {
+	chk := assert.New(t)
+	chk.NoError(validateConsumerBaggage(nil))
+	chk.NoError(validateConsumerBaggage(map[string]string{"user.id": "consumer.id"}))
+	chk.Error(validateConsumerBaggage(map[string]string{"user.id": "consumer.password"}))
+	chk.Error(validateConsumerBaggage(map[string]string{"user id": "consumer.id"}))
+}
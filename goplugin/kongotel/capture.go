@@ -0,0 +1,176 @@
+package kongotel
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redactedValue replaces the values of sensitive headers and parameters.
+const redactedValue = "REDACTED"
+
+// alwaysRedacted are the headers and query parameters whose values are
+// never recorded, whatever the config says: credentials, and the
+// signature parameters the semantic conventions would have us redact from
+// url.query.
+var alwaysRedacted = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"set-cookie",
+	"x-api-key",
+	"apikey",
+	"api_key",
+	"api-key",
+	"access_token",
+	"awsaccesskeyid",
+	"signature",
+	"sig",
+	"x-goog-signature",
+}
+
+// captureAll in an allowlist captures everything not excluded.
+const captureAll = "*"
+
+// capture records the headers and query parameters that the config's
+// allowlists ask for on the server span. Names are matched without
+// regard to case. A nil capture records nothing, and only redacts the
+// alwaysRedacted values in url.query.
+type capture struct {
+	requestHeaders  nameSet
+	responseHeaders nameSet
+	queryParams     nameSet
+	exclude         nameSet
+	redact          nameSet
+}
+
+type nameSet map[string]bool
+
+func newNameSet(names ...[]string) nameSet {
+	s := nameSet{}
+	for _, ns := range names {
+		for _, n := range ns {
+			s[strings.ToLower(n)] = true
+		}
+	}
+	return s
+}
+
+func (s nameSet) has(name string) bool {
+	return s[captureAll] || s[strings.ToLower(name)]
+}
+
+func newCapture(conf Config) *capture {
+	return &capture{
+		requestHeaders:  newNameSet(conf.CaptureRequestHeaders),
+		responseHeaders: newNameSet(conf.CaptureResponseHeaders),
+		queryParams:     newNameSet(conf.CaptureQueryParams),
+		exclude:         newNameSet(conf.CaptureExclude),
+		redact:          newNameSet(alwaysRedacted, conf.Redact),
+	}
+}
+
+var defaultRedact = newNameSet(alwaysRedacted)
+
+func (c *capture) redacts(name string) bool {
+	if c == nil {
+		return defaultRedact[strings.ToLower(name)]
+	}
+	return c.redact[strings.ToLower(name)]
+}
+
+// wants is whether the named value is allowed and not excluded.
+func (c *capture) wants(allow nameSet, name string) bool {
+	return c != nil && allow.has(name) && !c.exclude[strings.ToLower(name)]
+}
+
+// redactQuery replaces the values of sensitive parameters in a raw query
+// string, leaving the rest of it as it was.
+func (c *capture) redactQuery(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		key, _, hasValue := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && hasValue && c.redacts(name) {
+			params[i] = key + "=" + redactedValue
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// requestAttributes are the captured request headers and query parameters.
+func (c *capture) requestAttributes(headers http.Header, query string) []attribute.KeyValue {
+	if c == nil {
+		return nil
+	}
+	attrs := c.headerAttributes("http.request.header.", c.requestHeaders, headers)
+
+	if len(c.queryParams) == 0 || query == "" {
+		return attrs
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil && len(params) == 0 {
+		return attrs
+	}
+	for _, name := range sortedKeys(params) {
+		if c.wants(c.queryParams, name) {
+			attrs = append(attrs, c.attribute("http.request.query."+name, name, params[name]))
+		}
+	}
+	return attrs
+}
+
+// captureResponse records the captured headers of the response sent to the
+// client on span.
+func (c *capture) captureResponse(kong *pdk.PDK, span trace.Span) error {
+	if c == nil || len(c.responseHeaders) == 0 {
+		// Don't ask Kong for what we won't use
+		return nil
+	}
+	headers, err := kong.Response.GetHeaders(-1)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(c.headerAttributes("http.response.header.", c.responseHeaders, normalizeHeaders(headers))...)
+	return nil
+}
+
+// headerAttributes follow the semantic conventions, e.g.
+// http.request.header.content-type, with the header name in lower case.
+func (c *capture) headerAttributes(prefix string, allow nameSet, headers http.Header) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if len(allow) == 0 {
+		return attrs
+	}
+	for _, name := range sortedKeys(headers) {
+		if c.wants(allow, name) {
+			attrs = append(attrs, c.attribute(prefix+strings.ToLower(name), name, headers[name]))
+		}
+	}
+	return attrs
+}
+
+func (c *capture) attribute(key, name string, values []string) attribute.KeyValue {
+	if c.redacts(name) {
+		redacted := make([]string, len(values))
+		for i := range redacted {
+			redacted[i] = redactedValue
+		}
+		values = redacted
+	}
+	return attribute.StringSlice(key, values)
+}
+
+// sortedKeys keeps the order of the attributes stable.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package kongotel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestRedactQuery(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                          "",
+		"q=search&x=9":              "q=search&x=9",
+		"AWSAccessKeyId=AKIA&x=9":   "AWSAccessKeyId=REDACTED&x=9",
+		"x=1&Signature=abc%3D&sig=": "x=1&Signature=REDACTED&sig=REDACTED",
+		"X%2DGoog%2DSignature=abc":  "X%2DGoog%2DSignature=REDACTED",
+		"sig&Sig=":                  "sig&Sig=REDACTED",
+	} {
+		assert.Equal(t, want, (*capture)(nil).redactQuery(query), query)
+	}
+
+	c := newCapture(Config{Redact: []string{"token"}})
+	assert.Equal(t, "token=REDACTED&apikey=REDACTED&q=go", c.redactQuery("token=abc&apikey=def&q=go"))
+}
+
+func TestCapture_RequestAttributes(t *testing.T) {
+	headers := http.Header{
+		"Accept":        {"application/json"},
+		"Authorization": {"Bearer abc"},
+		"X-Request-Id":  {"42"},
+		"X-Secret":      {"shh"},
+	}
+	query := "q=go&apikey=abc&page=2"
+
+	for _, tc := range []struct {
+		name string
+		conf Config
+		want []attribute.KeyValue
+	}{
+		{"nothing by default", Config{}, nil},
+		{
+			"allowlisted",
+			Config{
+				CaptureRequestHeaders: []string{"accept", "authorization", "x-missing"},
+				CaptureQueryParams:    []string{"q", "apikey"},
+			},
+			[]attribute.KeyValue{
+				attribute.StringSlice("http.request.header.accept", []string{"application/json"}),
+				attribute.StringSlice("http.request.header.authorization", []string{"REDACTED"}),
+				attribute.StringSlice("http.request.query.apikey", []string{"REDACTED"}),
+				attribute.StringSlice("http.request.query.q", []string{"go"}),
+			},
+		},
+		{
+			"everything but excluded",
+			Config{
+				CaptureRequestHeaders: []string{"*"},
+				CaptureExclude:        []string{"Authorization", "x-secret"},
+				Redact:                []string{"x-request-id"},
+			},
+			[]attribute.KeyValue{
+				attribute.StringSlice("http.request.header.accept", []string{"application/json"}),
+				attribute.StringSlice("http.request.header.x-request-id", []string{"REDACTED"}),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, newCapture(tc.conf).requestAttributes(headers, query))
+		})
+	}
+}
+
+func TestCapture_ServerSpan(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin?q=go&access_token=abc",
+		Headers: map[string][]string{
+			"host":   {"localhost"},
+			"cookie": {"session=abc"},
+		},
+	})
+	chk.NoError(err)
+
+	New := NewPlugin(context.Background(), nil, func() interface{} { return &helloPlugin{} })
+	conf := New()
+	chk.NoError(conf.(*plugin).UnmarshalJSON([]byte(`{"otel": {
+		"capture_request_headers": ["Cookie"],
+		"capture_response_headers": ["x-hello"],
+		"capture_query_params": ["q"]
+	}}`)))
+	env.DoHttp(conf)
+
+	if chk.Len(*exporter.spans, 5) {
+		serverSpan := (*exporter.spans)[4]
+		chk.Subset(serverSpan.Attributes(), []attribute.KeyValue{
+			semconv.URLQuery("q=go&access_token=REDACTED"),
+			attribute.StringSlice("http.request.header.cookie", []string{"REDACTED"}),
+			attribute.StringSlice("http.request.query.q", []string{"go"}),
+			attribute.StringSlice("http.response.header.x-hello", []string{"localhost"}),
+		})
+	}
+}
@@ -0,0 +1,690 @@
+package kongotel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultQueueMaxBytes = 64 << 20
+
+	batchSuffix   = ".batch"
+	partialSuffix = ".tmp"
+)
+
+// How long to wait before exporting again after the collector fails,
+// doubling each time. Variables for the tests.
+var (
+	queueMinBackoff = 1 * time.Second
+	queueMaxBackoff = 1 * time.Minute
+)
+
+// The queues of old and new pipelines share a directory while the old one
+// finishes, so they take turns with it.
+var (
+	queueMu sync.Mutex
+	// sending are the batch files being exported, guarded by queueMu
+	sending = map[string]bool{}
+)
+
+// diskQueue is a SpanExporter that writes each batch to a file before
+// exporting it, so that spans survive the collector being down, and the
+// plugin server restarting. A goroutine exports the files oldest first,
+// retrying with backoff, starting with any left over from before.
+type diskQueue struct {
+	dir      string
+	maxBytes int64
+	next     trace.SpanExporter
+	// direct exports the batches that can't be queued, counting their
+	// spans as dropped if it fails
+	direct trace.SpanExporter
+
+	minBackoff, maxBackoff time.Duration
+
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// ctx is cancelled on stop, so an export doesn't outlive the queue
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// dropped counts the batches dropped to make room, or unreadable
+	dropped atomic.Int64
+}
+
+func newDiskQueue(dir string, maxBytes int64, next, direct trace.SpanExporter) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultQueueMaxBytes
+	}
+	q := &diskQueue{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		next:       next,
+		direct:     direct,
+		minBackoff: queueMinBackoff,
+		maxBackoff: queueMaxBackoff,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	go q.run()
+	return q, nil
+}
+
+// ExportSpans queues spans on disk. They're exported directly only if they
+// can't be written down.
+func (q *diskQueue) ExportSpans(ctx context.Context, spans []trace.ReadOnlySpan) error {
+	data, err := encodeBatch(spans)
+	if err == nil {
+		err = q.write(data)
+	}
+	if err != nil {
+		otel.Handle(fmt.Errorf("export queue: %w", err))
+		if err := q.direct.ExportSpans(ctx, spans); err != nil {
+			q.dropped.Add(1)
+			return err
+		}
+		return nil
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Shutdown stops retrying, and has one last go at exporting what's
+// queued, within ctx. Whatever's left is exported after the next start.
+func (q *diskQueue) Shutdown(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+		q.cancel()
+	})
+	var err error
+	select {
+	case <-q.done:
+		err = q.drain(ctx)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return errors.Join(err, q.next.Shutdown(ctx))
+}
+
+func (q *diskQueue) run() {
+	defer close(q.done)
+	backoff := q.minBackoff
+	for {
+		if err := q.drain(q.ctx); err != nil {
+			if q.ctx.Err() != nil {
+				// Stopped mid-export. Shutdown has another go.
+				return
+			}
+			otel.Handle(fmt.Errorf("export queue: %w", err))
+			timer := time.NewTimer(backoff)
+			select {
+			case <-q.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			backoff = min(2*backoff, q.maxBackoff)
+			continue
+		}
+		backoff = q.minBackoff
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		}
+	}
+}
+
+// drain exports the queued batches until there are none left, or one
+// fails.
+func (q *diskQueue) drain(ctx context.Context) error {
+	for {
+		path, ok := q.claimOldest()
+		if !ok {
+			return nil
+		}
+		err := q.send(ctx, path)
+		queueMu.Lock()
+		delete(sending, path)
+		queueMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send exports the batch in path, and removes it once it's gone.
+func (q *diskQueue) send(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Dropped to make room after it was claimed
+		q.dropped.Add(1)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	spans, err := decodeBatch(data)
+	if err != nil {
+		// It'll never get any better
+		otel.Handle(fmt.Errorf("export queue: dropping %s: %w", path, err))
+		q.dropped.Add(1)
+		return removeBatch(path)
+	}
+	if err := q.next.ExportSpans(ctx, spans); err != nil {
+		if _, statErr := os.Stat(path); errors.Is(statErr, os.ErrNotExist) {
+			// Dropped to make room while it was being sent
+			q.dropped.Add(1)
+		}
+		return err
+	}
+	return removeBatch(path)
+}
+
+func removeBatch(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// claimOldest picks the oldest batch that isn't already being sent.
+func (q *diskQueue) claimOldest() (string, bool) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	batches, err := q.batches()
+	if err != nil {
+		otel.Handle(fmt.Errorf("export queue: %w", err))
+		return "", false
+	}
+	for _, b := range batches {
+		if !sending[b.path] {
+			sending[b.path] = true
+			return b.path, true
+		}
+	}
+	return "", false
+}
+
+// registerMetrics reports the size of the queue, and the batches dropped
+// from it, with mp.
+func (q *diskQueue) registerMetrics(mp metric.MeterProvider) error {
+	meter := mp.Meter(ScopeName)
+	size, err := meter.Int64ObservableGauge("kongotel.export_queue.size",
+		metric.WithDescription("Size of the span batches queued on disk."),
+		metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	dropped, err := meter.Int64ObservableCounter("kongotel.export_queue.dropped_batches",
+		metric.WithDescription("Span batches dropped from the export queue."),
+		metric.WithUnit("{batch}"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		queueMu.Lock()
+		batches, err := q.batches()
+		queueMu.Unlock()
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, b := range batches {
+			total += b.size
+		}
+		o.ObserveInt64(size, total)
+		o.ObserveInt64(dropped, q.dropped.Load())
+		return nil
+	}, size, dropped)
+	return err
+}
+
+type batchFile struct {
+	path string
+	size int64
+}
+
+// batches are the queued batches, oldest first. queueMu must be held.
+func (q *diskQueue) batches() ([]batchFile, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var batches []batchFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), batchSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		batches = append(batches, batchFile{filepath.Join(q.dir, e.Name()), info.Size()})
+	}
+	// The names start with the time they were written
+	sort.Slice(batches, func(i, j int) bool { return batches[i].path < batches[j].path })
+	return batches, nil
+}
+
+// write adds a batch to the queue, dropping the oldest batches if there
+// isn't room for it. Batches being sent are only counted as dropped by
+// send, if they don't make it.
+func (q *diskQueue) write(data []byte) error {
+	size := int64(len(data))
+	if size > q.maxBytes {
+		return fmt.Errorf("export queue: a batch of %d bytes doesn't fit in export_queue_max_bytes", size)
+	}
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	batches, err := q.batches()
+	if err != nil {
+		return err
+	}
+	total := size
+	for _, b := range batches {
+		total += b.size
+	}
+	dropped := 0
+	for _, b := range batches {
+		if total <= q.maxBytes {
+			break
+		}
+		if err := removeBatch(b.path); err != nil {
+			return err
+		}
+		total -= b.size
+		if !sending[b.path] {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		q.dropped.Add(int64(dropped))
+		otel.Handle(fmt.Errorf("export queue: full, dropped the %d oldest batches", dropped))
+	}
+
+	// Written in full before it's renamed into the queue
+	f, err := os.CreateTemp(q.dir, fmt.Sprintf("%020d-*%s", time.Now().UnixNano(), partialSuffix))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	err = errors.Join(err, f.Sync(), f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), strings.TrimSuffix(f.Name(), partialSuffix)+batchSuffix)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// queuedBatch is how spans are written down. The SDK's spans can't be
+// marshalled as they are, so they're read back as queuedSnapshots.
+type queuedBatch struct {
+	Resources []queuedResource `json:"resources"`
+	Spans     []queuedSpan     `json:"spans"`
+}
+
+type queuedResource struct {
+	SchemaURL  string            `json:"schema_url"`
+	Attributes []queuedAttribute `json:"attributes"`
+}
+
+type queuedSpan struct {
+	Name              string                `json:"name"`
+	SpanContext       queuedSpanContext     `json:"span_context"`
+	Parent            queuedSpanContext     `json:"parent"`
+	Kind              oteltrace.SpanKind    `json:"kind"`
+	StartTime         time.Time             `json:"start_time"`
+	EndTime           time.Time             `json:"end_time"`
+	Attributes        []queuedAttribute     `json:"attributes"`
+	Events            []queuedEvent         `json:"events"`
+	Links             []queuedLink          `json:"links"`
+	StatusCode        codes.Code            `json:"status_code"`
+	StatusDescription string                `json:"status_description"`
+	DroppedAttributes int                   `json:"dropped_attributes"`
+	DroppedEvents     int                   `json:"dropped_events"`
+	DroppedLinks      int                   `json:"dropped_links"`
+	ChildSpanCount    int                   `json:"child_span_count"`
+	Resource          int                   `json:"resource"`
+	Scope             instrumentation.Scope `json:"scope"`
+}
+
+type queuedSpanContext struct {
+	TraceID    string `json:"trace_id"`
+	SpanID     string `json:"span_id"`
+	TraceFlags byte   `json:"trace_flags"`
+	TraceState string `json:"trace_state"`
+	Remote     bool   `json:"remote"`
+}
+
+type queuedEvent struct {
+	Name              string            `json:"name"`
+	Time              time.Time         `json:"time"`
+	Attributes        []queuedAttribute `json:"attributes"`
+	DroppedAttributes int               `json:"dropped_attributes"`
+}
+
+type queuedLink struct {
+	SpanContext       queuedSpanContext `json:"span_context"`
+	Attributes        []queuedAttribute `json:"attributes"`
+	DroppedAttributes int               `json:"dropped_attributes"`
+}
+
+// queuedAttribute is an attribute.KeyValue, whose Value can be marshalled
+// but not unmarshalled.
+type queuedAttribute struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func encodeBatch(spans []trace.ReadOnlySpan) ([]byte, error) {
+	return json.Marshal(newQueuedBatch(spans))
+}
+
+func decodeBatch(data []byte) ([]trace.ReadOnlySpan, error) {
+	var batch queuedBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	return batch.spans()
+}
+
+func newQueuedBatch(spans []trace.ReadOnlySpan) queuedBatch {
+	var b queuedBatch
+	resources := map[*resource.Resource]int{}
+	for _, s := range spans {
+		res, ok := resources[s.Resource()]
+		if !ok {
+			res = len(b.Resources)
+			resources[s.Resource()] = res
+			b.Resources = append(b.Resources, queuedResource{
+				SchemaURL:  s.Resource().SchemaURL(),
+				Attributes: newQueuedAttributes(s.Resource().Attributes()),
+			})
+		}
+		qs := queuedSpan{
+			Name:              s.Name(),
+			SpanContext:       newQueuedSpanContext(s.SpanContext()),
+			Parent:            newQueuedSpanContext(s.Parent()),
+			Kind:              s.SpanKind(),
+			StartTime:         s.StartTime(),
+			EndTime:           s.EndTime(),
+			Attributes:        newQueuedAttributes(s.Attributes()),
+			StatusCode:        s.Status().Code,
+			StatusDescription: s.Status().Description,
+			DroppedAttributes: s.DroppedAttributes(),
+			DroppedEvents:     s.DroppedEvents(),
+			DroppedLinks:      s.DroppedLinks(),
+			ChildSpanCount:    s.ChildSpanCount(),
+			Resource:          res,
+			Scope:             s.InstrumentationScope(),
+		}
+		for _, e := range s.Events() {
+			qs.Events = append(qs.Events, queuedEvent{
+				Name:              e.Name,
+				Time:              e.Time,
+				Attributes:        newQueuedAttributes(e.Attributes),
+				DroppedAttributes: e.DroppedAttributeCount,
+			})
+		}
+		for _, l := range s.Links() {
+			qs.Links = append(qs.Links, queuedLink{
+				SpanContext:       newQueuedSpanContext(l.SpanContext),
+				Attributes:        newQueuedAttributes(l.Attributes),
+				DroppedAttributes: l.DroppedAttributeCount,
+			})
+		}
+		b.Spans = append(b.Spans, qs)
+	}
+	return b
+}
+
+func (b queuedBatch) spans() ([]trace.ReadOnlySpan, error) {
+	resources := make([]*resource.Resource, len(b.Resources))
+	for i, r := range b.Resources {
+		attrs, err := attributesOf(r.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		resources[i] = resource.NewWithAttributes(r.SchemaURL, attrs...)
+	}
+
+	spans := make([]trace.ReadOnlySpan, 0, len(b.Spans))
+	for _, qs := range b.Spans {
+		if qs.Resource < 0 || qs.Resource >= len(resources) {
+			return nil, fmt.Errorf("span %q has no resource", qs.Name)
+		}
+		span := &queuedSnapshot{
+			name:              qs.Name,
+			kind:              qs.Kind,
+			startTime:         qs.StartTime,
+			endTime:           qs.EndTime,
+			status:            trace.Status{Code: qs.StatusCode, Description: qs.StatusDescription},
+			droppedAttributes: qs.DroppedAttributes,
+			droppedEvents:     qs.DroppedEvents,
+			droppedLinks:      qs.DroppedLinks,
+			childSpanCount:    qs.ChildSpanCount,
+			resource:          resources[qs.Resource],
+			scope:             qs.Scope,
+		}
+		var err error
+		if span.spanContext, err = qs.SpanContext.spanContext(); err != nil {
+			return nil, err
+		}
+		if span.parent, err = qs.Parent.spanContext(); err != nil {
+			return nil, err
+		}
+		if span.attributes, err = attributesOf(qs.Attributes); err != nil {
+			return nil, err
+		}
+		for _, qe := range qs.Events {
+			attrs, err := attributesOf(qe.Attributes)
+			if err != nil {
+				return nil, err
+			}
+			span.events = append(span.events, trace.Event{
+				Name:                  qe.Name,
+				Time:                  qe.Time,
+				Attributes:            attrs,
+				DroppedAttributeCount: qe.DroppedAttributes,
+			})
+		}
+		for _, ql := range qs.Links {
+			sc, err := ql.SpanContext.spanContext()
+			if err != nil {
+				return nil, err
+			}
+			attrs, err := attributesOf(ql.Attributes)
+			if err != nil {
+				return nil, err
+			}
+			span.links = append(span.links, trace.Link{
+				SpanContext:           sc,
+				Attributes:            attrs,
+				DroppedAttributeCount: ql.DroppedAttributes,
+			})
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// queuedSnapshot is a span read back from the queue. ReadOnlySpan can only
+// be implemented by embedding it, so the nil one embedded here has all of
+// its methods overridden.
+type queuedSnapshot struct {
+	trace.ReadOnlySpan
+
+	name              string
+	spanContext       oteltrace.SpanContext
+	parent            oteltrace.SpanContext
+	kind              oteltrace.SpanKind
+	startTime         time.Time
+	endTime           time.Time
+	attributes        []attribute.KeyValue
+	links             []trace.Link
+	events            []trace.Event
+	status            trace.Status
+	droppedAttributes int
+	droppedLinks      int
+	droppedEvents     int
+	childSpanCount    int
+	resource          *resource.Resource
+	scope             instrumentation.Scope
+}
+
+func (s *queuedSnapshot) Name() string                                { return s.name }
+func (s *queuedSnapshot) SpanContext() oteltrace.SpanContext          { return s.spanContext }
+func (s *queuedSnapshot) Parent() oteltrace.SpanContext               { return s.parent }
+func (s *queuedSnapshot) SpanKind() oteltrace.SpanKind                { return s.kind }
+func (s *queuedSnapshot) StartTime() time.Time                        { return s.startTime }
+func (s *queuedSnapshot) EndTime() time.Time                          { return s.endTime }
+func (s *queuedSnapshot) Attributes() []attribute.KeyValue            { return s.attributes }
+func (s *queuedSnapshot) Links() []trace.Link                         { return s.links }
+func (s *queuedSnapshot) Events() []trace.Event                       { return s.events }
+func (s *queuedSnapshot) Status() trace.Status                        { return s.status }
+func (s *queuedSnapshot) InstrumentationScope() instrumentation.Scope { return s.scope }
+func (s *queuedSnapshot) Resource() *resource.Resource                { return s.resource }
+func (s *queuedSnapshot) DroppedAttributes() int                      { return s.droppedAttributes }
+func (s *queuedSnapshot) DroppedLinks() int                           { return s.droppedLinks }
+func (s *queuedSnapshot) DroppedEvents() int                          { return s.droppedEvents }
+func (s *queuedSnapshot) ChildSpanCount() int                         { return s.childSpanCount }
+
+// InstrumentationLibrary is the deprecated name for InstrumentationScope.
+func (s *queuedSnapshot) InstrumentationLibrary() instrumentation.Library { //nolint:staticcheck // part of ReadOnlySpan
+	return s.scope
+}
+
+func newQueuedSpanContext(sc oteltrace.SpanContext) queuedSpanContext {
+	if !sc.IsValid() {
+		return queuedSpanContext{}
+	}
+	return queuedSpanContext{
+		TraceID:    sc.TraceID().String(),
+		SpanID:     sc.SpanID().String(),
+		TraceFlags: byte(sc.TraceFlags()),
+		TraceState: sc.TraceState().String(),
+		Remote:     sc.IsRemote(),
+	}
+}
+
+func (q queuedSpanContext) spanContext() (oteltrace.SpanContext, error) {
+	if q.TraceID == "" {
+		return oteltrace.SpanContext{}, nil
+	}
+	traceID, err := oteltrace.TraceIDFromHex(q.TraceID)
+	if err != nil {
+		return oteltrace.SpanContext{}, err
+	}
+	spanID, err := oteltrace.SpanIDFromHex(q.SpanID)
+	if err != nil {
+		return oteltrace.SpanContext{}, err
+	}
+	state, err := oteltrace.ParseTraceState(q.TraceState)
+	if err != nil {
+		return oteltrace.SpanContext{}, err
+	}
+	return oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.TraceFlags(q.TraceFlags),
+		TraceState: state,
+		Remote:     q.Remote,
+	}), nil
+}
+
+func newQueuedAttributes(attrs []attribute.KeyValue) []queuedAttribute {
+	queued := make([]queuedAttribute, 0, len(attrs))
+	for _, kv := range attrs {
+		value, err := json.Marshal(kv.Value.AsInterface())
+		if err != nil {
+			// e.g. a NaN, which JSON can't say
+			value, _ = json.Marshal(kv.Value.Emit())
+			queued = append(queued, queuedAttribute{string(kv.Key), attribute.STRING.String(), value})
+			continue
+		}
+		queued = append(queued, queuedAttribute{string(kv.Key), kv.Value.Type().String(), value})
+	}
+	return queued
+}
+
+func attributesOf(queued []queuedAttribute) ([]attribute.KeyValue, error) {
+	attrs := make([]attribute.KeyValue, 0, len(queued))
+	for _, qa := range queued {
+		kv, err := qa.keyValue()
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q: %w", qa.Key, err)
+		}
+		attrs = append(attrs, kv)
+	}
+	return attrs, nil
+}
+
+func (qa queuedAttribute) keyValue() (attribute.KeyValue, error) {
+	key := attribute.Key(qa.Key)
+	switch qa.Type {
+	case attribute.BOOL.String():
+		var v bool
+		err := json.Unmarshal(qa.Value, &v)
+		return key.Bool(v), err
+	case attribute.INT64.String():
+		var v int64
+		err := json.Unmarshal(qa.Value, &v)
+		return key.Int64(v), err
+	case attribute.FLOAT64.String():
+		var v float64
+		err := json.Unmarshal(qa.Value, &v)
+		return key.Float64(v), err
+	case attribute.STRING.String():
+		var v string
+		err := json.Unmarshal(qa.Value, &v)
+		return key.String(v), err
+	case attribute.BOOLSLICE.String():
+		var v []bool
+		err := json.Unmarshal(qa.Value, &v)
+		return key.BoolSlice(v), err
+	case attribute.INT64SLICE.String():
+		var v []int64
+		err := json.Unmarshal(qa.Value, &v)
+		return key.Int64Slice(v), err
+	case attribute.FLOAT64SLICE.String():
+		var v []float64
+		err := json.Unmarshal(qa.Value, &v)
+		return key.Float64Slice(v), err
+	case attribute.STRINGSLICE.String():
+		var v []string
+		err := json.Unmarshal(qa.Value, &v)
+		return key.StringSlice(v), err
+	}
+	return attribute.KeyValue{}, fmt.Errorf("unknown type %q", qa.Type)
+}
@@ -0,0 +1,256 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// downExporter is an exporter whose collector may be down, or hang.
+type downExporter struct {
+	*tracetest.InMemoryExporter
+	down     atomic.Bool
+	hang     atomic.Bool
+	attempts atomic.Int64
+	shutdown atomic.Bool
+}
+
+func (e *downExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.attempts.Add(1)
+	if e.hang.Load() {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if e.down.Load() {
+		return errors.New("connection refused")
+	}
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+func (e *downExporter) Shutdown(ctx context.Context) error {
+	e.shutdown.Store(true)
+	return e.InMemoryExporter.Shutdown(ctx)
+}
+
+func newTestDiskQueue(t *testing.T, dir string, maxBytes int64, down bool) (*diskQueue, *downExporter) {
+	minBackoff, maxBackoff := queueMinBackoff, queueMaxBackoff
+	queueMinBackoff, queueMaxBackoff = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { queueMinBackoff, queueMaxBackoff = minBackoff, maxBackoff })
+
+	exporter := &downExporter{InMemoryExporter: tracetest.NewInMemoryExporter()}
+	exporter.down.Store(down)
+	q, err := newDiskQueue(dir, maxBytes, exporter, exporter)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Shutdown(context.Background()) })
+	return q, exporter
+}
+
+func testSpans(t *testing.T, names ...string) []sdktrace.ReadOnlySpan {
+	recorder := tracetest.NewSpanRecorder()
+	res := resource.NewSchemaless(attribute.String("service.name", "kong"))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder), sdktrace.WithResource(res))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	for _, name := range names {
+		_, span := tp.Tracer(ScopeName).Start(context.Background(), name)
+		span.End()
+	}
+	return recorder.Ended()
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func queuedFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	return files
+}
+
+func TestDiskQueue_RoundTrip(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	res := resource.NewWithAttributes("https://opentelemetry.io/schemas/1.26.0",
+		attribute.String("service.name", "kong"))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder), sdktrace.WithResource(res))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	state, err := trace.ParseTraceState("vendor=value")
+	require.NoError(t, err)
+	remote := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+		TraceState: state,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), remote)
+	_, span := tp.Tracer(ScopeName, trace.WithInstrumentationVersion("1.0")).Start(ctx, "GET route_66",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithLinks(trace.Link{SpanContext: remote, Attributes: []attribute.KeyValue{attribute.Bool("linked", true)}}),
+		trace.WithAttributes(
+			attribute.Bool("bool", true),
+			attribute.Int64("int", 42),
+			attribute.Float64("float", 1.5),
+			attribute.String("string", "s"),
+			attribute.BoolSlice("bools", []bool{true, false}),
+			attribute.Int64Slice("ints", []int64{1, 2}),
+			attribute.Float64Slice("floats", []float64{0.5}),
+			attribute.StringSlice("strings", []string{"a", "b"}),
+		))
+	span.AddEvent("exception", trace.WithAttributes(attribute.String("exception.message", "boom")))
+	span.SetStatus(codes.Error, "boom")
+	span.End()
+
+	want := recorder.Ended()
+	data, err := encodeBatch(want)
+	require.NoError(t, err)
+	got, err := decodeBatch(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, utcStubs(want), utcStubs(got))
+}
+
+// utcStubs are the spans with times as they'd come back from JSON.
+func utcStubs(spans []sdktrace.ReadOnlySpan) tracetest.SpanStubs {
+	stubs := tracetest.SpanStubsFromReadOnlySpans(spans)
+	for i := range stubs {
+		stubs[i].StartTime = stubs[i].StartTime.UTC()
+		stubs[i].EndTime = stubs[i].EndTime.UTC()
+		for j := range stubs[i].Events {
+			stubs[i].Events[j].Time = stubs[i].Events[j].Time.UTC()
+		}
+	}
+	return stubs
+}
+
+func TestDiskQueue_Retry(t *testing.T) {
+	q, exporter := newTestDiskQueue(t, t.TempDir(), 0, true)
+
+	require.NoError(t, q.ExportSpans(context.Background(), testSpans(t, "first")))
+	require.NoError(t, q.ExportSpans(context.Background(), testSpans(t, "second")))
+	assert.Eventually(t, func() bool { return exporter.attempts.Load() >= 3 }, time.Second, time.Millisecond)
+	assert.Empty(t, exporter.GetSpans())
+
+	exporter.down.Store(false)
+	assert.Eventually(t, func() bool { return len(exporter.GetSpans()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"first", "second"}, spanNames(exporter.GetSpans()))
+	assert.Empty(t, queuedFiles(t, q.dir))
+}
+
+func TestDiskQueue_Replay(t *testing.T) {
+	dir := t.TempDir()
+
+	before, _ := newTestDiskQueue(t, dir, 0, true)
+	require.NoError(t, before.ExportSpans(context.Background(), testSpans(t, "before restart")))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = before.Shutdown(ctx)
+	assert.Len(t, queuedFiles(t, dir), 1)
+
+	_, exporter := newTestDiskQueue(t, dir, 0, false)
+	assert.Eventually(t, func() bool { return len(exporter.GetSpans()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"before restart"}, spanNames(exporter.GetSpans()))
+	assert.Equal(t, "kong", exporter.GetSpans()[0].Resource.Attributes()[0].Value.AsString())
+}
+
+func TestDiskQueue_Full(t *testing.T) {
+	dir := t.TempDir()
+	data, err := encodeBatch(testSpans(t, "batch"))
+	require.NoError(t, err)
+	q, exporter := newTestDiskQueue(t, dir, int64(2*len(data)+len(data)/2), true)
+
+	for _, name := range []string{"first", "second", "third"} {
+		require.NoError(t, q.ExportSpans(context.Background(), testSpans(t, name)))
+	}
+	assert.Len(t, queuedFiles(t, dir), 2)
+
+	exporter.down.Store(false)
+	assert.Eventually(t, func() bool { return len(exporter.GetSpans()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"second", "third"}, spanNames(exporter.GetSpans()))
+	assert.Equal(t, int64(1), q.dropped.Load())
+}
+
+func TestDiskQueue_FullWhileSending(t *testing.T) {
+	dir := t.TempDir()
+	data, err := encodeBatch(testSpans(t, "batch"))
+	require.NoError(t, err)
+	q, exporter := newTestDiskQueue(t, dir, int64(len(data)+len(data)/2), true)
+	// Only the test sends
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	require.NoError(t, q.write(data))
+	path, ok := q.claimOldest()
+	require.True(t, ok)
+	t.Cleanup(func() {
+		queueMu.Lock()
+		delete(sending, path)
+		queueMu.Unlock()
+	})
+	require.NoError(t, q.write(data))
+	assert.Equal(t, int64(0), q.dropped.Load(), "it may yet be sent")
+
+	assert.NoError(t, q.send(context.Background(), path))
+	assert.Equal(t, int64(1), q.dropped.Load())
+	assert.Empty(t, exporter.GetSpans())
+}
+
+func TestDiskQueue_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000001-x.batch"), []byte("{"), 0o600))
+
+	q, exporter := newTestDiskQueue(t, dir, 0, false)
+	require.NoError(t, q.ExportSpans(context.Background(), testSpans(t, "fine")))
+	assert.Eventually(t, func() bool { return len(exporter.GetSpans()) == 1 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return len(queuedFiles(t, dir)) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestDiskQueue_Unwritable(t *testing.T) {
+	dir := t.TempDir()
+	q, exporter := newTestDiskQueue(t, dir, 0, false)
+	// Even root can't write into a file
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.WriteFile(dir, nil, 0o600))
+
+	require.NoError(t, q.ExportSpans(context.Background(), testSpans(t, "direct")))
+	assert.Equal(t, []string{"direct"}, spanNames(exporter.GetSpans()))
+	assert.Equal(t, int64(0), q.dropped.Load())
+
+	exporter.down.Store(true)
+	assert.Error(t, q.ExportSpans(context.Background(), testSpans(t, "lost")))
+	assert.Equal(t, int64(1), q.dropped.Load())
+}
+
+func TestDiskQueue_ShutdownHung(t *testing.T) {
+	q, exporter := newTestDiskQueue(t, t.TempDir(), 0, false)
+	exporter.hang.Store(true)
+	require.NoError(t, q.ExportSpans(context.Background(), testSpans(t, "stuck")))
+	assert.Eventually(t, func() bool { return exporter.attempts.Load() == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.Shutdown(ctx), context.DeadlineExceeded)
+	assert.True(t, exporter.shutdown.Load(), "the exporter is shut down all the same")
+	select {
+	case <-q.done:
+	default:
+		t.Error("the queue is still exporting")
+	}
+	exporter.hang.Store(false)
+}
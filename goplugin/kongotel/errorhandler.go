@@ -0,0 +1,74 @@
+package kongotel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Kong/go-pdk"
+)
+
+// At most errorLogBurst SDK errors are logged each errorLogWindow.
+const (
+	errorLogBurst  = 10
+	errorLogWindow = time.Minute
+)
+
+// errorLog is the SDK's error handler, which writes its errors to Kong's
+// error log. The SDK's errors happen away from any request, so they wait
+// for the next request's log phase to write them with its PDK.
+// A collector that's down fails every export, so errors beyond the first
+// few each minute are only counted, and the count logged with the next.
+type errorLog struct {
+	now func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	logged      int
+	suppressed  int
+	pending     []string
+}
+
+func newErrorLog() *errorLog {
+	return &errorLog{now: time.Now}
+}
+
+func (l *errorLog) Handle(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.windowStart) >= errorLogWindow {
+		l.windowStart = now
+		l.logged = 0
+	}
+	if l.logged >= errorLogBurst || len(l.pending) >= errorLogBurst {
+		l.suppressed++
+		return
+	}
+	l.logged++
+	msg := "opentelemetry: " + err.Error()
+	if l.suppressed > 0 {
+		msg += fmt.Sprintf(" (%d more errors suppressed)", l.suppressed)
+		l.suppressed = 0
+	}
+	l.pending = append(l.pending, msg)
+}
+
+// flush writes the errors handled since the last flush.
+func (l *errorLog) flush(write func(msg string)) {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	for _, msg := range pending {
+		write(msg)
+	}
+}
+
+// logErrors writes the SDK's errors to Kong's error log with kong.
+func (t *Telemetry) logErrors(kong *pdk.PDK) {
+	if t == nil {
+		return
+	}
+	t.errors.flush(func(msg string) { _ = kong.Log.Err(msg) })
+}
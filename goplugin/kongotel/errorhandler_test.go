@@ -0,0 +1,39 @@
+package kongotel
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLog(t *testing.T) {
+	chk := assert.New(t)
+	now := time.Now()
+	l := newErrorLog()
+	l.now = func() time.Time { return now }
+	var logged []string
+	write := func(msg string) { logged = append(logged, msg) }
+
+	for i := 0; i < errorLogBurst+5; i++ {
+		l.Handle(fmt.Errorf("export failed %d", i))
+	}
+	l.flush(write)
+	chk.Len(logged, errorLogBurst)
+	chk.Equal("opentelemetry: export failed 0", logged[0])
+
+	logged = nil
+	l.flush(write)
+	chk.Empty(logged, "flushed already")
+
+	l.Handle(errors.New("still failing"))
+	l.flush(write)
+	chk.Empty(logged, "within the minute")
+
+	now = now.Add(errorLogWindow)
+	l.Handle(errors.New("still failing"))
+	l.flush(write)
+	chk.Equal([]string{"opentelemetry: still failing (6 more errors suppressed)"}, logged)
+}
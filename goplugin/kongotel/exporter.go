@@ -0,0 +1,247 @@
+package kongotel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+// OTLP protocols, as used by OTEL_EXPORTER_OTLP_PROTOCOL
+const (
+	protocolHTTPProtobuf = "http/protobuf"
+	protocolHTTPJSON     = "http/json"
+	protocolGRPC         = "grpc"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionNone = "none"
+)
+
+func validateExporter(c Config) error {
+	switch c.ExporterOTLPProtocol {
+	case protocolHTTPProtobuf, protocolHTTPJSON, protocolGRPC:
+	default:
+		return fmt.Errorf("unknown exporter_otlp_protocol %q", c.ExporterOTLPProtocol)
+	}
+	switch c.ExporterOTLPCompression {
+	case "", compressionGzip, compressionNone:
+	default:
+		return fmt.Errorf("unknown exporter_otlp_compression %q", c.ExporterOTLPCompression)
+	}
+	if (c.ExporterOTLPClientCertificate == "") != (c.ExporterOTLPClientKey == "") {
+		return fmt.Errorf("exporter_otlp_client_certificate and exporter_otlp_client_key must be set together")
+	}
+	return nil
+}
+
+// useEnv is whether the exporters configure themselves from the standard
+// OTEL_EXPORTER_OTLP_* env vars, with the plugin's settings on top.
+func useEnv() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""
+}
+
+// exporterSettings are the settings that the trace, metric and log
+// exporters share, read from a Config once for all three.
+type exporterSettings struct {
+	protocol string
+	// endpoint is empty if it's left to the env
+	endpoint string
+	headers  map[string]string
+	gzip     bool
+	// tls is nil if the defaults will do
+	tls *tls.Config
+}
+
+func newExporterSettings(c Config) (exporterSettings, error) {
+	tlsCfg, err := c.tlsConfig()
+	if err != nil {
+		return exporterSettings{}, err
+	}
+	s := exporterSettings{
+		protocol: c.ExporterOTLPProtocol,
+		headers:  c.ExporterOTLPHeaders,
+		gzip:     c.ExporterOTLPCompression == compressionGzip,
+		tls:      tlsCfg,
+	}
+	if useEnv() {
+		// The env's endpoint wins, but headers set in both are merged
+		s.headers = withEnvHeaders(c.ExporterOTLPHeaders)
+		return s, nil
+	}
+	s.endpoint = c.ExporterOTLPEndpoint
+	return s, nil
+}
+
+// withEnvHeaders adds the headers in OTEL_EXPORTER_OTLP_HEADERS to headers,
+// which the exporters would otherwise replace them with.
+func withEnvHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	merged := envHeaders()
+	for k, v := range headers {
+		merged[k] = v
+	}
+	return merged
+}
+
+// envHeaders are the headers in OTEL_EXPORTER_OTLP_HEADERS, which are
+// comma separated key=value pairs, with the values URL encoded.
+func envHeaders() map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if v, err := url.PathUnescape(v); err == nil {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return headers
+}
+
+// tlsConfig returns the TLS settings for the exporter, or nil if the
+// defaults will do.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.ExporterOTLPCertificate == "" && c.ExporterOTLPClientCertificate == "" {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{}
+	if c.ExporterOTLPCertificate != "" {
+		pem, err := os.ReadFile(c.ExporterOTLPCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("reading exporter_otlp_certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ExporterOTLPCertificate)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.ExporterOTLPClientCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(c.ExporterOTLPClientCertificate, c.ExporterOTLPClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading exporter_otlp_client_certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// exporterOptions are how one of the OTLP exporter packages takes each of
+// the exporterSettings.
+type exporterOptions[O any] struct {
+	endpointURL func(string) O
+	headers     func(map[string]string) O
+	gzip        O
+	tls         func(*tls.Config) O
+}
+
+func (o exporterOptions[O]) from(s exporterSettings) []O {
+	var opts []O
+	if s.endpoint != "" {
+		opts = append(opts, o.endpointURL(s.endpoint))
+	}
+	if s.headers != nil {
+		opts = append(opts, o.headers(s.headers))
+	}
+	if s.gzip {
+		opts = append(opts, o.gzip)
+	}
+	if s.tls != nil {
+		opts = append(opts, o.tls(s.tls))
+	}
+	return opts
+}
+
+var (
+	traceGRPCOptions = exporterOptions[otlptracegrpc.Option]{
+		endpointURL: otlptracegrpc.WithEndpointURL,
+		headers:     otlptracegrpc.WithHeaders,
+		gzip:        otlptracegrpc.WithCompressor(compressionGzip),
+		tls: func(c *tls.Config) otlptracegrpc.Option {
+			return otlptracegrpc.WithTLSCredentials(credentials.NewTLS(c))
+		},
+	}
+	traceHTTPOptions = exporterOptions[otlptracehttp.Option]{
+		endpointURL: otlptracehttp.WithEndpointURL,
+		headers:     otlptracehttp.WithHeaders,
+		gzip:        otlptracehttp.WithCompression(otlptracehttp.GzipCompression),
+		tls:         otlptracehttp.WithTLSClientConfig,
+	}
+	metricGRPCOptions = exporterOptions[otlpmetricgrpc.Option]{
+		endpointURL: otlpmetricgrpc.WithEndpointURL,
+		headers:     otlpmetricgrpc.WithHeaders,
+		gzip:        otlpmetricgrpc.WithCompressor(compressionGzip),
+		tls: func(c *tls.Config) otlpmetricgrpc.Option {
+			return otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(c))
+		},
+	}
+	metricHTTPOptions = exporterOptions[otlpmetrichttp.Option]{
+		endpointURL: otlpmetrichttp.WithEndpointURL,
+		headers:     otlpmetrichttp.WithHeaders,
+		gzip:        otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression),
+		tls:         otlpmetrichttp.WithTLSClientConfig,
+	}
+	logGRPCOptions = exporterOptions[otlploggrpc.Option]{
+		endpointURL: otlploggrpc.WithEndpointURL,
+		headers:     otlploggrpc.WithHeaders,
+		gzip:        otlploggrpc.WithCompressor(compressionGzip),
+		tls: func(c *tls.Config) otlploggrpc.Option {
+			return otlploggrpc.WithTLSCredentials(credentials.NewTLS(c))
+		},
+	}
+	logHTTPOptions = exporterOptions[otlploghttp.Option]{
+		endpointURL: otlploghttp.WithEndpointURL,
+		headers:     otlploghttp.WithHeaders,
+		gzip:        otlploghttp.WithCompression(otlploghttp.GzipCompression),
+		tls:         otlploghttp.WithTLSClientConfig,
+	}
+)
+
+func newTraceExporter(ctx context.Context, s exporterSettings) (trace.SpanExporter, error) {
+	switch s.protocol {
+	case protocolGRPC:
+		return otlptracegrpc.New(ctx, traceGRPCOptions.from(s)...)
+	case protocolHTTPJSON:
+		return newJSONTraceExporter(ctx, s)
+	}
+	return otlptracehttp.New(ctx, traceHTTPOptions.from(s)...)
+}
+
+func newMetricExporter(ctx context.Context, s exporterSettings) (metric.Exporter, error) {
+	switch s.protocol {
+	case protocolGRPC:
+		return otlpmetricgrpc.New(ctx, metricGRPCOptions.from(s)...)
+	case protocolHTTPJSON:
+		return newJSONMetricExporter(s), nil
+	}
+	return otlpmetrichttp.New(ctx, metricHTTPOptions.from(s)...)
+}
+
+func newLogExporter(ctx context.Context, s exporterSettings) (sdklog.Exporter, error) {
+	switch s.protocol {
+	case protocolGRPC:
+		return otlploggrpc.New(ctx, logGRPCOptions.from(s)...)
+	case protocolHTTPJSON:
+		return newJSONLogExporter(s), nil
+	}
+	return otlploghttp.New(ctx, logHTTPOptions.from(s)...)
+}
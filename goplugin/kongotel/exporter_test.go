@@ -0,0 +1,135 @@
+package kongotel
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExporter_Protocol(t *testing.T) {
+	chk := assert.New(t)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "")
+	chk.Equal(protocolHTTPProtobuf, Config{}.withDefaults().ExporterOTLPProtocol)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	chk.Equal(protocolGRPC, Config{}.withDefaults().ExporterOTLPProtocol)
+	chk.Equal(protocolHTTPProtobuf,
+		Config{ExporterOTLPProtocol: protocolHTTPProtobuf}.withDefaults().ExporterOTLPProtocol,
+		"plugin config wins over the env")
+}
+
+func TestExporter_Validate(t *testing.T) {
+	for _, conf := range []Config{
+		{ExporterOTLPProtocol: "carrier-pigeon"},
+		{ExporterOTLPCompression: "zstd"},
+		{ExporterOTLPClientCertificate: "client.pem"},
+	} {
+		assert.Error(t, conf.withDefaults().validate(), "%+v", conf)
+	}
+}
+
+func TestExporter_New(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	ctx := context.Background()
+
+	for _, protocol := range []string{protocolHTTPProtobuf, protocolHTTPJSON, protocolGRPC} {
+		t.Run(protocol, func(t *testing.T) {
+			chk := assert.New(t)
+			conf := Config{
+				ExporterOTLPEndpoint:    "http://localhost:4317",
+				ExporterOTLPProtocol:    protocol,
+				ExporterOTLPCompression: compressionGzip,
+			}.withDefaults()
+			chk.NoError(conf.validate())
+			exp, err := newExporterSettings(conf)
+			chk.NoError(err)
+
+			traceExporter, err := newTraceExporter(ctx, exp)
+			if chk.NoError(err) {
+				chk.NoError(traceExporter.Shutdown(ctx))
+			}
+			metricExporter, err := newMetricExporter(ctx, exp)
+			if chk.NoError(err) {
+				chk.NoError(metricExporter.Shutdown(ctx))
+			}
+			logExporter, err := newLogExporter(ctx, exp)
+			if chk.NoError(err) {
+				chk.NoError(logExporter.Shutdown(ctx))
+			}
+		})
+	}
+}
+
+func TestExporter_Env(t *testing.T) {
+	chk := assert.New(t)
+
+	got := make(chan *http.Request, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case got <- r:
+		default:
+		}
+	}))
+	t.Cleanup(collector.Close)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "env=yes,both=env%20value")
+
+	// The plugin's settings apply on top of the env's
+	conf := Config{
+		ExporterOTLPEndpoint:    "http://apm-server:8200",
+		ExporterOTLPHeaders:     map[string]string{"both": "plugin", "plugin": "yes"},
+		ExporterOTLPCompression: compressionGzip,
+	}.withDefaults()
+	exp, err := newExporterSettings(conf)
+	chk.NoError(err)
+	chk.Empty(exp.endpoint)
+	chk.Equal(map[string]string{"env": "yes", "both": "plugin", "plugin": "yes"}, exp.headers)
+
+	ctx := context.Background()
+	exporter, err := newTraceExporter(ctx, exp)
+	if !chk.NoError(err) {
+		return
+	}
+	t.Cleanup(func() { _ = exporter.Shutdown(ctx) })
+	chk.NoError(exporter.ExportSpans(ctx, testSpans(t, "span")))
+	r := <-got
+	chk.Equal("/v1/traces", r.URL.Path)
+	chk.Equal("yes", r.Header.Get("env"))
+	chk.Equal("plugin", r.Header.Get("both"))
+	chk.Equal("yes", r.Header.Get("plugin"))
+	chk.Equal("gzip", r.Header.Get("Content-Encoding"))
+}
+
+func TestExporter_TLSConfig(t *testing.T) {
+	chk := assert.New(t)
+
+	tlsCfg, err := Config{}.tlsConfig()
+	chk.NoError(err)
+	chk.Nil(tlsCfg, "use the system defaults")
+
+	_, err = Config{ExporterOTLPCertificate: "/does/not/exist.pem"}.tlsConfig()
+	chk.Error(err)
+
+	collector := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(collector.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: collector.Certificate().Raw})
+	chk.NoError(os.WriteFile(caFile, caPEM, 0o600))
+
+	tlsCfg, err = Config{ExporterOTLPCertificate: caFile}.tlsConfig()
+	if chk.NoError(err) {
+		chk.NotNil(tlsCfg.RootCAs)
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	chk.NoError(os.WriteFile(notPEM, []byte("hello"), 0o600))
+	_, err = Config{ExporterOTLPCertificate: notPEM}.tlsConfig()
+	chk.Error(err)
+}
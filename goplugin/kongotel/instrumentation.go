@@ -0,0 +1,303 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const ScopeName = "goplugin"
+
+const (
+	kongRouteNameKey   = attribute.Key("kong.route.name")
+	kongServiceNameKey = attribute.Key("kong.service.name")
+	kongConsumerIDKey  = attribute.Key("kong.consumer.id")
+	kongPDKMethodKey   = attribute.Key("kong.pdk.method")
+)
+
+var (
+	tracer = otel.Tracer(ScopeName)
+)
+
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	return tp.Tracer(ScopeName)
+}
+func getTracer(span trace.Span) trace.Tracer {
+	return newTracer(span.TracerProvider())
+}
+
+// Inspiration ...
+// "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+// serverRequest is what the PDK tells us about a request as its server
+// span starts.
+type serverRequest struct {
+	headers http.Header
+	method  string
+	path    string
+	scheme  string
+	route   routeInfo
+	// attrs are the rest of the HTTP server attributes
+	attrs []attribute.KeyValue
+	// trusted is whether to continue the client's trace
+	trusted bool
+	// failed are the PDK calls that couldn't tell us
+	failed []pdkCallError
+}
+
+// readServerRequest asks Kong about the request, capturing the headers and
+// query parameters that opts ask for.
+func readServerRequest(kong *pdk.PDK, opts requestOptions) serverRequest {
+	var r serverRequest
+	c := opts.capture
+
+	// Certain actions here seem to break the trace.
+	// But when it doesn' break, it doesn't seem to do much at all.. :(
+	headers, err := kong.Request.GetHeaders(-1)
+	if err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_headers", err})
+	} else {
+		r.headers = normalizeHeaders(headers)
+	}
+
+	r.method, err = kong.Request.GetMethod()
+	if err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_method", err})
+	}
+
+	r.path, err = kong.Request.GetPath()
+	if err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_path", err})
+	}
+
+	// Kong only believes X-Forwarded-Proto from trusted_ips
+	if scheme, err := kong.Request.GetForwardedScheme(); err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_forwarded_scheme", err})
+	} else if scheme != "" {
+		r.scheme = scheme
+		r.attrs = append(r.attrs, semconv.URLScheme(scheme))
+	}
+
+	query, err := kong.Request.GetRawQuery()
+	if err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_raw_query", err})
+	} else if query != "" {
+		r.attrs = append(r.attrs, semconv.URLQuery(c.redactQuery(query)))
+	}
+
+	if host, err := kong.Request.GetHost(); err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_host", err})
+	} else if host != "" {
+		r.attrs = append(r.attrs, semconv.ServerAddress(host))
+	}
+
+	if port, err := kong.Request.GetPort(); err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_port", err})
+	} else if port > 0 {
+		r.attrs = append(r.attrs, semconv.ServerPort(port))
+	}
+
+	// Likewise for X-Forwarded-For, or whatever real_ip_header is
+	if ip, err := kong.Client.GetForwardedIp(); err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.client.get_forwarded_ip", err})
+	} else if ip != "" {
+		r.attrs = append(r.attrs, semconv.ClientAddress(ip))
+	}
+
+	if version, err := kong.Request.GetHttpVersion(); err != nil {
+		r.failed = append(r.failed, pdkCallError{"kong.request.get_http_version", err})
+	} else if version > 0 {
+		r.attrs = append(r.attrs, semconv.NetworkProtocolVersion(strconv.FormatFloat(version, 'f', -1, 64)))
+	}
+
+	if userAgent := r.headers.Get("User-Agent"); userAgent != "" {
+		r.attrs = append(r.attrs, semconv.UserAgentOriginal(userAgent))
+	}
+
+	r.attrs = append(r.attrs, c.requestAttributes(r.headers, query)...)
+
+	r.route = readRoute(kong, r.path)
+	if opts.extracts() {
+		r.trusted = opts.trust.trusts(kong, &r)
+	}
+	return r
+}
+
+func (r serverRequest) err() error {
+	var errs []error
+	for _, f := range r.failed {
+		errs = append(errs, f)
+	}
+	return errors.Join(errs...)
+}
+
+// startServerSpan starts the server span for a request.
+// A span is started even if the PDK calls for the request's details
+// failed, with the failures recorded on it, so broken requests still show
+// up in traces.
+func startServerSpan(octx context.Context, tp trace.TracerProvider, r serverRequest, opts requestOptions) (context.Context, trace.Span) {
+	ctx := octx
+	spanOpts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindServer),
+	}
+	if r.headers != nil && opts.extracts() {
+		remote := otel.GetTextMapPropagator().Extract(octx, propagation.HeaderCarrier(r.headers))
+		if r.trusted {
+			ctx = remote
+		} else if sc := trace.SpanContextFromContext(remote); sc.IsValid() {
+			// Their baggage is no more trustworthy, so it's left behind
+			spanOpts = append(spanOpts, trace.WithNewRoot(), trace.WithLinks(trace.Link{SpanContext: sc}))
+		}
+	}
+	if r.method != "" {
+		spanOpts = append(spanOpts, trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.method)))
+	}
+	if r.path != "" {
+		spanOpts = append(spanOpts, trace.WithAttributes(semconv.URLPath(r.path)))
+	}
+	spanOpts = append(spanOpts, trace.WithAttributes(r.attrs...))
+	spanOpts = append(spanOpts, trace.WithAttributes(r.route.attrs...))
+
+	ctx, span := newTracer(tp).Start(ctx, serverSpanName(r.method, r.route.target()), spanOpts...)
+
+	for _, f := range r.failed {
+		RecordPDKError(span, f.method, f.err)
+	}
+	return ctx, span
+}
+
+// serverSpanName names the server span "METHOD target", where target is
+// the route the request matched, so that span names don't have the
+// cardinality of raw paths. Without a route it's just the method.
+func serverSpanName(method, target string) string {
+	switch {
+	case method == "":
+		return "HTTP"
+	case target == "":
+		return method
+	default:
+		return fmt.Sprintf("%s %s", method, target)
+	}
+}
+
+// routeInfo is the Kong route and service that a request matched.
+type routeInfo struct {
+	// known is whether the router has run
+	known bool
+	name  string
+	// httpRoute is whichever of the route's paths matched
+	httpRoute string
+	attrs     []attribute.KeyValue
+}
+
+// readRoute asks Kong for the request's route and service. There's no
+// route for global plugins before the router has run, in the rewrite
+// phase.
+func readRoute(kong *pdk.PDK, path string) routeInfo {
+	route, err := kong.Router.GetRoute()
+	if err != nil || route.Id == "" {
+		return routeInfo{}
+	}
+	r := routeInfo{known: true, name: route.Name}
+	if r.name != "" {
+		r.attrs = append(r.attrs, kongRouteNameKey.String(r.name))
+	}
+	if r.httpRoute = matchRoutePath(route.Paths, path); r.httpRoute != "" {
+		r.attrs = append(r.attrs, semconv.HTTPRoute(r.httpRoute))
+	}
+	if service, err := kong.Router.GetService(); err == nil && service.Name != "" {
+		r.attrs = append(r.attrs, kongServiceNameKey.String(service.Name))
+	}
+	return r
+}
+
+// target is what to name the span after: the path that matched, or else
+// the route's name.
+func (r routeInfo) target() string {
+	if r.httpRoute != "" {
+		return r.httpRoute
+	}
+	return r.name
+}
+
+var routeRegexps sync.Map // map[string]*regexp.Regexp, nil if it won't compile
+
+// matchRoutePath finds which of a route's paths the request path matched.
+// As in Kong, paths starting with "~" are regexes, which take precedence,
+// and otherwise the longest matching prefix wins.
+func matchRoutePath(paths []string, path string) string {
+	longest := ""
+	for _, p := range paths {
+		if pattern, ok := strings.CutPrefix(p, "~"); ok {
+			re, ok := routeRegexps.Load(p)
+			if !ok {
+				// Kong's regexes are PCRE, so some won't be RE2
+				compiled, err := regexp.Compile("^(?:" + pattern + ")")
+				if err != nil {
+					compiled = nil
+				}
+				re, _ = routeRegexps.LoadOrStore(p, compiled)
+			}
+			if re := re.(*regexp.Regexp); re != nil && re.MatchString(path) {
+				return p
+			}
+			continue
+		}
+		if strings.HasPrefix(path, p) && len(p) > len(longest) {
+			longest = p
+		}
+	}
+	return longest
+}
+
+// pdkCallError is a failed call to the Kong PDK.
+type pdkCallError struct {
+	method string
+	err    error
+}
+
+func (e pdkCallError) Error() string { return fmt.Sprintf("%s: %s", e.method, e.err) }
+func (e pdkCallError) Unwrap() error { return e.err }
+
+// RecordPDKError records a failed PDK call on span, and marks the span as
+// failed. method is the PDK function, e.g. "kong.request.get_header".
+func RecordPDKError(span trace.Span, method string, err error) {
+	span.RecordError(err, trace.WithAttributes(kongPDKMethodKey.String(method)))
+	span.SetStatus(codes.Error, pdkCallError{method, err}.Error())
+}
+
+// setResponseStatus records the response status code on a server span.
+// Following the HTTP semantic conventions, only 5xx responses (and codes
+// that aren't valid HTTP at all) mark the span as an error.
+func setResponseStatus(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status < 100 || status >= 600 {
+		span.SetStatus(codes.Error, fmt.Sprintf("Invalid HTTP status code %d", status))
+	} else if status >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
+}
+
+// If the headers aren't in normal form, they're not found
+func normalizeHeaders(headers map[string][]string) http.Header {
+	result := http.Header{}
+	for k, vs := range headers {
+		for _, v := range vs {
+			result.Add(k, v)
+		}
+	}
+	return result
+}
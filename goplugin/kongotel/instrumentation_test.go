@@ -0,0 +1,548 @@
+package kongotel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/server/kong_plugin_protocol"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestExtraction(t *testing.T) {
+
+	headers := map[string][]string{
+		"traceparent": {"00-f68de45b0b36ac1c97c2a43166c9cb8f-9a94fd01ca53f63d-01"},
+	}
+	carrier := http.Header{}
+	for k, vs := range headers {
+		for _, v := range vs {
+			carrier.Add(k, v)
+		}
+	}
+
+	propagator := propagation.TraceContext{}
+	ctx := context.TODO()
+
+	newCtx := propagator.Extract(ctx, propagation.HeaderCarrier(carrier))
+
+	sc := trace.SpanContextFromContext(newCtx)
+	if sc.IsValid() {
+		j, err := sc.MarshalJSON()
+		t.Logf("spancontext: %q, %q", j, err)
+	} else {
+		j, err := sc.MarshalJSON()
+		t.Logf("invalid span context: %q, %q", j, err)
+	}
+
+	if newCtx == ctx {
+		t.Fail()
+	}
+}
+
+type fakeExporter struct {
+	spans *[]sdktrace.ReadOnlySpan
+}
+
+func NewFakeExporter() *fakeExporter {
+	spans := []sdktrace.ReadOnlySpan{}
+	return &fakeExporter{&spans}
+}
+
+func (fe fakeExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	*fe.spans = append(*fe.spans, spans...)
+	return nil
+}
+func (fe fakeExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+var _ sdktrace.SpanExporter = fakeExporter{}
+
+func setupOTEL(t *testing.T, e sdktrace.SpanExporter) {
+	ctx := context.TODO()
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(e))
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { _ = tp.Shutdown(ctx) })
+}
+
+func TestInstrumentation_NoParent(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin?q=search&x=9",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	conf := newTestPlugin()
+	conf.otel.TracePDKCalls = true
+
+	env.DoHttp(conf)
+
+	if chk.Len(*exporter.spans, 7) {
+		names := []string{}
+		for _, span := range *exporter.spans {
+			names = append(names, span.Name())
+		}
+		chk.Equal([]string{
+			"Rewrite", "kong.request.get_header", "kong.response.set_header",
+			"Access", "Response", "Log", "GET route_66",
+		}, names)
+
+		serverSpan := (*exporter.spans)[6]
+		chk.False(serverSpan.Parent().IsValid())
+		chk.Equal(trace.SpanKindServer, serverSpan.SpanKind())
+
+		for _, phase := range []int{0, 3, 4, 5} {
+			chk.Equal(serverSpan.SpanContext().SpanID(), (*exporter.spans)[phase].Parent().SpanID())
+		}
+		access := (*exporter.spans)[3]
+		chk.Equal(access.SpanContext().SpanID(), (*exporter.spans)[1].Parent().SpanID())
+		chk.Equal(access.SpanContext().SpanID(), (*exporter.spans)[2].Parent().SpanID())
+	}
+	chk.Empty(requests.requests, "request state released after log phase")
+}
+
+func TestInstrumentation_AccessOnly(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	// Route plugins don't see the rewrite phase
+	conf := newTestPlugin()
+	env.DoHttp(routePlugin{conf})
+
+	if chk.Len(*exporter.spans, 4) {
+		chk.Equal("GET route_66", (*exporter.spans)[3].Name())
+	}
+}
+
+func TestInstrumentation_Route(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/v1/this/42",
+	})
+	chk.NoError(err)
+
+	env.DoHttp(newTestPlugin())
+
+	if chk.Len(*exporter.spans, 5) {
+		serverSpan := (*exporter.spans)[4]
+		chk.Equal("GET /v1/this", serverSpan.Name())
+		chk.Subset(serverSpan.Attributes(), []attribute.KeyValue{
+			semconv.HTTPRoute("/v1/this"),
+			semconv.URLPath("/v1/this/42"),
+			kongRouteNameKey.String("route_66"),
+			kongServiceNameKey.String("self_service"),
+			kongConsumerIDKey.String("001"),
+		})
+	}
+}
+
+func TestInstrumentation_ServerAttributes(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com:8000/plugin?q=search&sig=s3cr3t",
+		Headers: map[string][]string{
+			"host":              {"example.com:8000"},
+			"user-agent":        {"curl/8.5.0"},
+			"x-forwarded-proto": {"https"},
+		},
+	})
+	chk.NoError(err)
+
+	env.DoHttp(newTestPlugin())
+
+	if chk.Len(*exporter.spans, 5) {
+		serverSpan := (*exporter.spans)[4]
+		chk.Subset(serverSpan.Attributes(), []attribute.KeyValue{
+			semconv.HTTPRequestMethodKey.String("GET"),
+			semconv.URLScheme("https"),
+			semconv.URLPath("/plugin"),
+			semconv.URLQuery("q=search&sig=REDACTED"),
+			semconv.ServerAddress("example.com"),
+			semconv.ServerPort(8000),
+			semconv.ClientAddress("10.10.10.1"),
+			semconv.NetworkProtocolVersion("1.1"),
+			semconv.UserAgentOriginal("curl/8.5.0"),
+		})
+		chk.Equal(codes.Unset, serverSpan.Status().Code)
+	}
+}
+
+// routingPlugin routes the request in its rewrite phase, as Kong's router
+// runs between rewrite and access.
+type routingPlugin struct {
+	env   *test.TestEnv
+	route *kong_plugin_protocol.Route
+}
+
+func (p routingPlugin) Rewrite(kong *pdk.PDK) { p.env.Route = p.route }
+
+func TestInstrumentation_RoutedAfterRewrite(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/v0/left",
+	})
+	chk.NoError(err)
+	inner := routingPlugin{env: env, route: env.Route}
+	env.Route = nil
+
+	New := NewPlugin(context.Background(), nil, func() interface{} { return inner })
+	env.DoHttp(New())
+
+	if chk.Len(*exporter.spans, 5) {
+		serverSpan := (*exporter.spans)[4]
+		chk.Equal("GET /v0/left", serverSpan.Name())
+		chk.Contains(serverSpan.Attributes(), semconv.HTTPRoute("/v0/left"))
+	}
+}
+
+func TestMatchRoutePath(t *testing.T) {
+	for _, tc := range []struct {
+		paths []string
+		path  string
+		want  string
+	}{
+		{nil, "/plugin", ""},
+		{[]string{"/v0/left", "/v1/this"}, "/plugin", ""},
+		{[]string{"/v0/left", "/v1/this"}, "/v1/this/that", "/v1/this"},
+		{[]string{"/", "/v1", "/v1/this"}, "/v1/this/that", "/v1/this"},
+		{[]string{"/v1", `~/v1/\d+$`}, "/v1/42", `~/v1/\d+$`},
+		{[]string{"/v1", `~/v1/\d+$`}, "/v1/forty-two", "/v1"},
+		{[]string{`~/users/(?<id>\w+)`}, "/x/users/jon", ""},
+		{[]string{`~(?=lookahead)`, "/"}, "/lookahead", "/"},
+	} {
+		assert.Equal(t, tc.want, matchRoutePath(tc.paths, tc.path), "%q in %q", tc.path, tc.paths)
+	}
+}
+
+func TestInstrumentation_ResponseStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		code   codes.Code
+	}{
+		{200, codes.Unset},
+		{404, codes.Unset},
+		{503, codes.Error},
+	} {
+		t.Run(strconv.Itoa(tc.status), func(t *testing.T) {
+			chk := assert.New(t)
+
+			exporter := NewFakeExporter()
+			setupOTEL(t, exporter)
+
+			env, err := test.New(t, test.Request{
+				Method:  "GET",
+				Url:     "http://example.com/plugin",
+				Headers: map[string][]string{"host": {"localhost"}},
+			})
+			chk.NoError(err)
+
+			conf := newTestPlugin()
+			env.DoAccess(conf)
+			env.ServiceRes = test.Response{Status: tc.status, Headers: http.Header{}}
+			env.DoResponse(conf)
+			env.DoLog(conf)
+
+			if chk.NotEmpty(*exporter.spans) {
+				serverSpan := (*exporter.spans)[len(*exporter.spans)-1]
+				chk.Contains(serverSpan.Attributes(), semconv.HTTPResponseStatusCode(tc.status))
+				chk.Equal(tc.code, serverSpan.Status().Code)
+			}
+		})
+	}
+}
+
+// pdkMethods lists the PDK methods recorded against a span's error events.
+func pdkMethods(span sdktrace.ReadOnlySpan) []string {
+	methods := []string{}
+	for _, event := range span.Events() {
+		if event.Name != semconv.ExceptionEventName {
+			continue
+		}
+		for _, kv := range event.Attributes {
+			if kv.Key == kongPDKMethodKey {
+				methods = append(methods, kv.Value.AsString())
+			}
+		}
+	}
+	return methods
+}
+
+func TestInstrumentation_PDKErrors(t *testing.T) {
+	t.Run("request details", func(t *testing.T) {
+		chk := assert.New(t)
+
+		exporter := NewFakeExporter()
+		setupOTEL(t, exporter)
+
+		env, err := test.New(t, test.Request{
+			Method:  "GET",
+			Url:     "http://example.com/plugin",
+			Headers: map[string][]string{"host": {"localhost"}},
+		})
+		chk.NoError(err)
+		env.Failing["kong.request.get_headers"] = true
+		env.Failing["kong.request.get_method"] = true
+		env.Failing["kong.request.get_path"] = true
+
+		env.DoHttp(newTestPlugin())
+
+		if chk.NotEmpty(*exporter.spans) {
+			serverSpan := (*exporter.spans)[len(*exporter.spans)-1]
+			chk.Equal("HTTP", serverSpan.Name(), "still traced")
+			chk.Equal(codes.Error, serverSpan.Status().Code)
+			chk.Equal([]string{
+				"kong.request.get_headers", "kong.request.get_method", "kong.request.get_path",
+			}, pdkMethods(serverSpan))
+		}
+		chk.Empty(requests.requests)
+	})
+
+	t.Run("in a phase", func(t *testing.T) {
+		chk := assert.New(t)
+
+		exporter := NewFakeExporter()
+		setupOTEL(t, exporter)
+
+		env, err := test.New(t, test.Request{
+			Method:  "GET",
+			Url:     "http://example.com/plugin",
+			Headers: map[string][]string{"host": {"localhost"}},
+		})
+		chk.NoError(err)
+		env.Failing["kong.request.get_header"] = true
+
+		env.DoHttp(newTestPlugin())
+
+		names := []string{}
+		for _, span := range *exporter.spans {
+			names = append(names, span.Name())
+			switch span.Name() {
+			case "Access":
+				chk.Equal(codes.Error, span.Status().Code)
+				chk.Contains(span.Status().Description, "kong.request.get_header")
+				chk.Equal([]string{"kong.request.get_header"}, pdkMethods(span))
+			case "GET route_66":
+				chk.Equal(codes.Unset, span.Status().Code)
+			}
+		}
+		chk.Contains(names, "Access")
+	})
+}
+
+// routePlugin hides Rewrite, as Kong only runs it for global plugins
+type routePlugin struct{ conf *plugin }
+
+func (p routePlugin) Access(kong *pdk.PDK)   { p.conf.Access(kong) }
+func (p routePlugin) Response(kong *pdk.PDK) { p.conf.Response(kong) }
+func (p routePlugin) Log(kong *pdk.PDK)      { p.conf.Log(kong) }
+
+type accessFunc func(ctx context.Context, kong *pdk.PDK)
+type testConfig struct {
+	baseContext context.Context
+	access      accessFunc
+}
+
+func (c *testConfig) Access(kong *pdk.PDK) {
+	c.access(c.baseContext, kong)
+}
+func mkTestNew(ctx context.Context, a accessFunc) func() interface{} {
+	New := func() interface{} {
+		return &testConfig{
+			baseContext: ctx,
+			access:      a,
+		}
+	}
+	return New
+}
+
+// beginRequest starts the server span for a request as the plugin's first
+// phase would, and returns a func that ends it as the log phase would.
+func beginRequest(ctx context.Context, kong *pdk.PDK) (*requestTelemetry, func(), error) {
+	rt, err := requests.begin(ctx, kong, nil, requestOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rt, func() {
+		if rt, ok := requests.finish(kong); ok {
+			rt.end()
+		}
+	}, nil
+}
+
+func TestInstrumentation_WithParent(t *testing.T) {
+
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin?q=search&x=9",
+		Headers: map[string][]string{
+			"host":        {"localhost"},
+			"traceparent": {"00-f68de45b0b36ac1c97c2a43166c9cb8f-9a94fd01ca53f63d-01"},
+		},
+	})
+	chk.NoError(err)
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		rt, end, err := beginRequest(ctx, kong)
+		if !chk.NoError(err) {
+			return
+		}
+		defer end()
+		ctx, span := rt.ctx, rt.span
+
+		_, childSpan := getTracer(span).Start(ctx, "Get Host")
+		_, _ = kong.Request.GetHost()
+		childSpan.End()
+	}
+
+	New := mkTestNew(context.Background(), access)
+
+	env.DoAccess(New())
+
+	if chk.GreaterOrEqual(len(*exporter.spans), 1, "spans non-empty") {
+		finalSpan := (*exporter.spans)[len(*exporter.spans)-1]
+		chk.Equal("GET route_66", finalSpan.Name())
+
+		chk.True(finalSpan.SpanContext().IsValid(), "SpanContext valid")
+		chk.False(finalSpan.SpanContext().IsRemote(), "SpanContext remote")
+		chk.True(finalSpan.SpanContext().IsSampled(), "SpanContext sampled")
+		chk.True(finalSpan.Parent().IsValid(), "Parent valid")
+		chk.True(finalSpan.Parent().IsRemote(), "Parent remote")
+	}
+
+	if chk.Equal(2, len(*exporter.spans), "has child span") {
+		childSpan := (*exporter.spans)[0]
+		chk.Equal("Get Host", childSpan.Name())
+
+		chk.True(childSpan.SpanContext().IsValid(), "child valid")
+		chk.False(childSpan.SpanContext().IsRemote(), "child remote")
+		chk.True(childSpan.SpanContext().IsSampled(), "child sampled")
+		chk.True(childSpan.Parent().IsValid(), "child parent valid")
+		chk.False(childSpan.Parent().IsRemote(), "child parent remote")
+		chk.Equal(trace.SpanKindInternal, childSpan.SpanKind())
+	}
+}
+
+func TestInstrumentation_WithClientCall(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin?q=search&x=9",
+		Headers: map[string][]string{
+			"host":        {"localhost"},
+			"traceparent": {"00-f68de45b0b36ac1c97c2a43166c9cb8f-9a94fd01ca53f63d-01"},
+		},
+	})
+	chk.NoError(err)
+
+	fakeUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp := r.Header.Get("traceparent")
+		chk.Contains(tp, "00-f68de45b0b36ac1c97c2a43166c9cb8f-")
+		chk.NotContains(tp, "-9a94fd01ca53f63d-")
+		w.Write([]byte("ok"))
+	}))
+	defer fakeUpstream.Close()
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		rt, end, err := beginRequest(ctx, kong)
+		if !chk.NoError(err) {
+			return
+		}
+		defer end()
+		ctx = rt.ctx
+
+		// This is almost about checking whether I am able to use
+		// opentelemetry correctly than whether the instrumentation works...
+		client := http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fakeUpstream.URL+"/", nil)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := client.Do(req)
+		chk.NoError(err)
+		defer resp.Body.Close()
+		chk.Equal(200, resp.StatusCode)
+	}
+
+	New := mkTestNew(context.Background(), access)
+
+	env.DoAccess(New())
+
+	if chk.GreaterOrEqual(len(*exporter.spans), 1, "spans non-empty") {
+		finalSpan := (*exporter.spans)[len(*exporter.spans)-1]
+		chk.Equal("GET route_66", finalSpan.Name())
+		chk.True(finalSpan.SpanContext().IsValid(), "valid")
+		chk.Equal(trace.SpanKindServer, finalSpan.SpanKind())
+	}
+
+	if chk.Equal(2, len(*exporter.spans), "has child span") {
+		childSpan := (*exporter.spans)[0]
+		chk.Equal("HTTP GET", childSpan.Name())
+
+		chk.True(childSpan.SpanContext().IsValid(), "valid")
+		chk.False(childSpan.SpanContext().IsRemote(), "remote")
+		chk.True(childSpan.SpanContext().IsSampled(), "sampled")
+		chk.True(childSpan.Parent().IsValid(), "parent valid")
+		chk.False(childSpan.Parent().IsRemote(), "parent remote")
+		chk.Equal(trace.SpanKindClient, childSpan.SpanKind())
+	}
+}
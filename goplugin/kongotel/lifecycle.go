@@ -0,0 +1,188 @@
+package kongotel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Each phase of a request arrives as a separate event from Kong, so we
+// stash an id in kong.ctx.shared and keep the span for it here until the
+// log phase.
+const sharedRequestIDKey = "goplugin.otel_request_id"
+
+const (
+	// requestTimeout bounds how long we hold on to a request whose log
+	// phase never arrived, e.g. because Kong restarted underneath us.
+	requestTimeout = 10 * time.Minute
+	sweepInterval  = 1 * time.Minute
+)
+
+// requestTelemetry is the telemetry state of one request as it passes
+// through the plugin's phases.
+type requestTelemetry struct {
+	ctx       context.Context
+	span      trace.Span
+	startTime time.Time
+	method    string
+	path      string
+	scheme    string
+	// routed is whether the span has the route, which it won't if the
+	// request began before the router ran
+	routed bool
+	// routeAttrs are the route and service, for the metrics
+	routeAttrs []attribute.KeyValue
+	// continued is whether the span continues the client's trace
+	continued bool
+	metrics   *serverMetrics
+	// release lets go of the telemetry pipeline the span belongs to
+	release func()
+}
+
+// end ends the server span and releases its pipeline.
+func (rt *requestTelemetry) end() {
+	rt.metrics.requestEnded(rt.ctx, rt.method, rt.scheme)
+	rt.span.End()
+	rt.release()
+}
+
+// setRoute names the server span after the request's route, once the
+// router has matched one.
+func (rt *requestTelemetry) setRoute(kong *pdk.PDK) {
+	route := readRoute(kong, rt.path)
+	if !route.known {
+		return
+	}
+	rt.routed = true
+	rt.routeAttrs = route.attrs
+	rt.span.SetAttributes(route.attrs...)
+	rt.span.SetName(serverSpanName(rt.method, route.target()))
+}
+
+// startPhase starts an internal span for a plugin phase as a child of the
+// request's server span.
+func (rt *requestTelemetry) startPhase(name string) (context.Context, trace.Span) {
+	return getTracer(rt.span).Start(rt.ctx, name)
+}
+
+type requestRegistry struct {
+	mu        sync.Mutex
+	requests  map[string]*requestTelemetry
+	lastSweep time.Time
+}
+
+func newRequestRegistry() *requestRegistry {
+	return &requestRegistry{
+		requests:  map[string]*requestTelemetry{},
+		lastSweep: time.Now(),
+	}
+}
+
+var requests = newRequestRegistry()
+
+// begin returns the telemetry for the current request, starting the server
+// span if this is the first phase of the request that we've seen.
+// Global plugins see the rewrite phase first but route plugins don't,
+// so any phase may be first.
+func (r *requestRegistry) begin(octx context.Context, kong *pdk.PDK, t *Telemetry, opts requestOptions) (*requestTelemetry, error) {
+	if rt, ok := r.lookup(kong); ok {
+		return rt, nil
+	}
+
+	tp, metrics, lp, release := t.acquire()
+	req := readServerRequest(kong, opts)
+	ctx, span := startServerSpan(octx, tp, req, opts)
+	// The request's errors are logged with its own pipeline
+	ctx = withLogger(ctx, lp.Logger(ScopeName))
+	if err := req.err(); err != nil {
+		// They're on the span, but carry on so the request is still traced
+		LogError(ctx, kong, err)
+	}
+	rt := &requestTelemetry{
+		ctx:        ctx,
+		span:       span,
+		startTime:  time.Now(),
+		method:     req.method,
+		path:       req.path,
+		scheme:     req.scheme,
+		routed:     req.route.known,
+		routeAttrs: req.route.attrs,
+		continued:  req.trusted,
+		metrics:    metrics,
+		release:    release,
+	}
+	metrics.requestStarted(ctx, req.method, req.scheme)
+
+	id, err := newRequestID()
+	if err != nil {
+		rt.end()
+		return nil, err
+	}
+	if err := kong.Ctx.SetShared(sharedRequestIDKey, id); err != nil {
+		RecordPDKError(span, "kong.ctx.shared.set", err)
+		rt.end()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.requests[id] = rt
+	r.sweep(rt.startTime)
+	r.mu.Unlock()
+
+	return rt, nil
+}
+
+// lookup finds the telemetry of a request started in an earlier phase.
+func (r *requestRegistry) lookup(kong *pdk.PDK) (*requestTelemetry, bool) {
+	id, err := kong.Ctx.GetSharedString(sharedRequestIDKey)
+	if err != nil || id == "" {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rt, ok := r.requests[id]
+	return rt, ok
+}
+
+// finish removes the request from the registry. The caller is responsible
+// for ending it.
+func (r *requestRegistry) finish(kong *pdk.PDK) (*requestTelemetry, bool) {
+	id, err := kong.Ctx.GetSharedString(sharedRequestIDKey)
+	if err != nil || id == "" {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rt, ok := r.requests[id]
+	delete(r.requests, id)
+	return rt, ok
+}
+
+// sweep ends and forgets requests that have outlived requestTimeout.
+// r.mu must be held.
+func (r *requestRegistry) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < sweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for id, rt := range r.requests {
+		if now.Sub(rt.startTime) > requestTimeout {
+			rt.end()
+			delete(r.requests, id)
+		}
+	}
+}
+
+func newRequestID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
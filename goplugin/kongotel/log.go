@@ -0,0 +1,47 @@
+package kongotel
+
+import (
+	"context"
+	"time"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+)
+
+// LogError writes err to Kong's error log, and emits it as an OTLP log
+// record so that it turns up next to the trace of the span in ctx, with
+// the logger of ctx's request.
+func LogError(ctx context.Context, kong *pdk.PDK, err error) {
+	_ = kong.Log.Err(err.Error())
+	emitLog(ctx, log.SeverityError, err.Error())
+}
+
+type loggerKey struct{}
+
+// withLogger returns ctx with the logger of its request's pipeline.
+func withLogger(ctx context.Context, logger log.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// emitLog emits a log record via the logger of ctx's request, or the
+// global logger provider outside of a request.
+// The SDK takes the trace and span ids from ctx.
+func emitLog(ctx context.Context, severity log.Severity, msg string) {
+	logger, ok := ctx.Value(loggerKey{}).(log.Logger)
+	if !ok {
+		logger = global.Logger(ScopeName)
+	}
+
+	var r log.Record
+	r.SetSeverity(severity)
+	if !logger.Enabled(ctx, r) {
+		return
+	}
+	now := time.Now()
+	r.SetTimestamp(now)
+	r.SetObservedTimestamp(now)
+	r.SetSeverityText(severity.String())
+	r.SetBody(log.StringValue(msg))
+	logger.Emit(ctx, r)
+}
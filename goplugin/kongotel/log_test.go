@@ -0,0 +1,152 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/Kong/go-pdk"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type fakeLogExporter struct {
+	mu      sync.Mutex
+	records []sdklog.Record
+}
+
+func (fe *fakeLogExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	for _, r := range records {
+		fe.records = append(fe.records, r.Clone())
+	}
+	return nil
+}
+func (fe *fakeLogExporter) Shutdown(ctx context.Context) error   { return nil }
+func (fe *fakeLogExporter) ForceFlush(ctx context.Context) error { return nil }
+
+var _ sdklog.Exporter = &fakeLogExporter{}
+
+func setupOTELLogs(t *testing.T, e sdklog.Exporter) {
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(e)))
+
+	prev := global.GetLoggerProvider()
+	global.SetLoggerProvider(lp)
+	t.Cleanup(func() {
+		global.SetLoggerProvider(prev)
+		_ = lp.Shutdown(context.TODO())
+	})
+}
+
+func TestLogError(t *testing.T) {
+	chk := assert.New(t)
+
+	spans := NewFakeExporter()
+	setupOTEL(t, spans)
+	logs := &fakeLogExporter{}
+	setupOTELLogs(t, logs)
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		rt, end, err := beginRequest(ctx, kong)
+		if !chk.NoError(err) {
+			return
+		}
+		defer end()
+		ctx = rt.ctx
+
+		LogError(ctx, kong, errors.New("something went wrong"))
+	}
+	env.DoAccess(mkTestNew(context.Background(), access)())
+
+	if chk.Len(logs.records, 1) && chk.Len(*spans.spans, 1) {
+		record := logs.records[0]
+		span := (*spans.spans)[0]
+		chk.Equal(log.SeverityError, record.Severity())
+		chk.Equal("ERROR", record.SeverityText())
+		chk.Equal("something went wrong", record.Body().AsString())
+		chk.Equal(span.SpanContext().TraceID(), record.TraceID())
+		chk.Equal(span.SpanContext().SpanID(), record.SpanID())
+		chk.False(record.Timestamp().IsZero())
+	}
+}
+
+func TestLogError_NoSpan(t *testing.T) {
+	chk := assert.New(t)
+
+	logs := &fakeLogExporter{}
+	setupOTELLogs(t, logs)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+	})
+	chk.NoError(err)
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		LogError(ctx, kong, errors.New("no trace here"))
+	}
+	env.DoAccess(mkTestNew(context.Background(), access)())
+
+	if chk.Len(logs.records, 1) {
+		chk.False(logs.records[0].TraceID().IsValid())
+	}
+}
+
+// TestLogError_RequestPipeline checks that a request's errors go to the
+// pipeline it's traced with, which may no longer be the global one after a
+// config push.
+func TestLogError_RequestPipeline(t *testing.T) {
+	chk := assert.New(t)
+
+	globalLogs := &fakeLogExporter{}
+	setupOTELLogs(t, globalLogs)
+	logs := &fakeLogExporter{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(logs)))
+	tp := sdktrace.NewTracerProvider()
+	t.Cleanup(func() {
+		_ = lp.Shutdown(context.Background())
+		_ = tp.Shutdown(context.Background())
+	})
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	tel.current = &pipeline{tracerProvider: tp, metrics: noopServerMetrics(), loggerProvider: lp}
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+	})
+	chk.NoError(err)
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		rt, err := requests.begin(ctx, kong, tel, requestOptions{})
+		if !chk.NoError(err) {
+			return
+		}
+		defer func() {
+			if rt, ok := requests.finish(kong); ok {
+				rt.end()
+			}
+		}()
+		LogError(rt.ctx, kong, errors.New("on the request's pipeline"))
+	}
+	env.DoAccess(mkTestNew(context.Background(), access)())
+
+	chk.Empty(globalLogs.records)
+	if chk.Len(logs.records, 1) {
+		chk.Equal("on the request's pipeline", logs.records[0].Body().AsString())
+		chk.True(logs.records[0].TraceID().IsValid())
+	}
+}
@@ -0,0 +1,153 @@
+package kongotel
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// serverMetrics are the HTTP server metrics from the semantic conventions,
+// https://opentelemetry.io/docs/specs/semconv/http/http-metrics/
+type serverMetrics struct {
+	duration       metric.Float64Histogram
+	activeRequests metric.Int64UpDownCounter
+	requestSize    metric.Int64Histogram
+	responseSize   metric.Int64Histogram
+
+	baggage *baggageValues
+}
+
+func newServerMetrics(mp metric.MeterProvider) (*serverMetrics, error) {
+	meter := mp.Meter(ScopeName)
+	m := &serverMetrics{baggage: newBaggageValues()}
+	var err error
+	m.duration, err = meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of HTTP server requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(
+			0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10))
+	if err != nil {
+		return nil, err
+	}
+	m.activeRequests, err = meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of active HTTP server requests."),
+		metric.WithUnit("{request}"))
+	if err != nil {
+		return nil, err
+	}
+	m.requestSize, err = meter.Int64Histogram("http.server.request.body.size",
+		metric.WithDescription("Size of HTTP server request bodies."),
+		metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	m.responseSize, err = meter.Int64Histogram("http.server.response.body.size",
+		metric.WithDescription("Size of HTTP server response bodies."),
+		metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// globalMetrics are the server metrics of the global meter provider,
+// made again only when it changes.
+var globalMetrics struct {
+	sync.Mutex
+	mp      metric.MeterProvider
+	metrics *serverMetrics
+}
+
+// globalServerMetrics is for when the plugin isn't managing the SDK itself,
+// e.g. in tests.
+func globalServerMetrics() *serverMetrics {
+	mp := otel.GetMeterProvider()
+	globalMetrics.Lock()
+	defer globalMetrics.Unlock()
+	if globalMetrics.metrics != nil && globalMetrics.mp == mp {
+		return globalMetrics.metrics
+	}
+	m, err := newServerMetrics(mp)
+	if err != nil {
+		otel.Handle(err)
+		m = noopServerMetrics()
+	}
+	globalMetrics.mp, globalMetrics.metrics = mp, m
+	return m
+}
+
+// noopServerMetrics are server metrics that record nothing.
+func noopServerMetrics() *serverMetrics {
+	m, _ := newServerMetrics(noop.NewMeterProvider())
+	return m
+}
+
+// requestStarted counts the request as active until requestEnded.
+func (m *serverMetrics) requestStarted(ctx context.Context, method, scheme string) {
+	m.activeRequests.Add(ctx, 1, metric.WithAttributes(activeAttributes(method, scheme)...))
+}
+
+func (m *serverMetrics) requestEnded(ctx context.Context, method, scheme string) {
+	m.activeRequests.Add(ctx, -1, metric.WithAttributes(activeAttributes(method, scheme)...))
+}
+
+// activeAttributes are the attributes of http.server.active_requests, which
+// are those known as soon as the request arrives.
+func activeAttributes(method, scheme string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(method),
+	}
+	if scheme != "" {
+		attrs = append(attrs, semconv.URLScheme(scheme))
+	}
+	return attrs
+}
+
+// recordRequest records the duration and sizes of a completed request.
+// It's called from the log phase, when everything about the response is
+// known. Besides the semantic conventions' attributes, they have the Kong
+// route and service, as read when the request was routed, and the promoted
+// baggage, bounded.
+func (m *serverMetrics) recordRequest(ctx context.Context, kong *pdk.PDK, method, scheme string, route []attribute.KeyValue, status int, duration time.Duration, promoted ...attribute.KeyValue) {
+	attrs := activeAttributes(method, scheme)
+	// http.route, kong.route.name and kong.service.name
+	attrs = append(attrs, route...)
+	attrs = append(attrs, m.baggage.bound(promoted)...)
+	if status != 0 {
+		attrs = append(attrs, semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			attrs = append(attrs, semconv.ErrorTypeKey.String(strconv.Itoa(status)))
+		}
+	}
+	opt := metric.WithAttributes(attrs...)
+
+	m.duration.Record(ctx, duration.Seconds(), opt)
+
+	if size, ok := contentLength(kong.Request.GetHeader("Content-Length")); ok {
+		m.requestSize.Record(ctx, size, opt)
+	}
+	if size, ok := contentLength(kong.Response.GetHeader("Content-Length")); ok {
+		m.responseSize.Record(ctx, size, opt)
+	}
+}
+
+// contentLength parses a Content-Length header, if there is one.
+// Chunked bodies have no length up front, so go unrecorded.
+func contentLength(value string, err error) (int64, bool) {
+	if err != nil || value == "" {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
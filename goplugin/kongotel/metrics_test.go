@@ -0,0 +1,122 @@
+package kongotel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func setupMetrics(t *testing.T) *sdkmetric.ManualReader {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(mp)
+	t.Cleanup(func() {
+		_ = mp.Shutdown(context.Background())
+		otel.SetMeterProvider(noop.NewMeterProvider())
+	})
+	return reader
+}
+
+func collect(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			result[m.Name] = m.Data
+		}
+	}
+	return result
+}
+
+func TestMetrics(t *testing.T) {
+	chk := assert.New(t)
+	reader := setupMetrics(t)
+
+	env, err := test.New(t, test.Request{
+		Method: "POST",
+		Url:    "http://example.com/plugin",
+		Headers: map[string][]string{
+			"host":           {"localhost"},
+			"content-length": {"7"},
+		},
+		Body: []byte("rolling"),
+	})
+	chk.NoError(err)
+	env.Route.Paths = append(env.Route.Paths, "/plugin")
+
+	conf := newTestPlugin()
+	env.DoAccess(conf)
+
+	metrics := collect(t, reader)
+	if active, ok := metrics["http.server.active_requests"].(metricdata.Sum[int64]); chk.True(ok) {
+		chk.Equal(int64(1), active.DataPoints[0].Value, "request in flight")
+		chk.Equal(attribute.NewSet(
+			semconv.HTTPRequestMethodKey.String("POST"),
+			semconv.URLScheme("http"),
+		), active.DataPoints[0].Attributes)
+	}
+	chk.Same(globalServerMetrics(), globalServerMetrics(), "made once for the meter provider")
+
+	env.ServiceRes = test.Response{
+		Status:  502,
+		Headers: http.Header{"Content-Length": {"11"}},
+		Body:    []byte("bad gateway"),
+	}
+	env.DoResponse(conf)
+	env.DoLog(conf)
+
+	metrics = collect(t, reader)
+	if active, ok := metrics["http.server.active_requests"].(metricdata.Sum[int64]); chk.True(ok) {
+		chk.Equal(int64(0), active.DataPoints[0].Value, "request finished")
+	}
+
+	wantAttrs := attribute.NewSet(
+		semconv.HTTPRequestMethodKey.String("POST"),
+		semconv.URLScheme("http"),
+		semconv.HTTPRoute("/plugin"),
+		semconv.HTTPResponseStatusCode(502),
+		semconv.ErrorTypeKey.String("502"),
+		kongRouteNameKey.String("route_66"),
+		kongServiceNameKey.String("self_service"),
+	)
+	if duration, ok := metrics["http.server.request.duration"].(metricdata.Histogram[float64]); chk.True(ok) {
+		if chk.Len(duration.DataPoints, 1) {
+			chk.Equal(uint64(1), duration.DataPoints[0].Count)
+			chk.Equal(wantAttrs, duration.DataPoints[0].Attributes)
+		}
+	}
+	if size, ok := metrics["http.server.request.body.size"].(metricdata.Histogram[int64]); chk.True(ok) {
+		chk.Equal(int64(7), size.DataPoints[0].Sum)
+	}
+	if size, ok := metrics["http.server.response.body.size"].(metricdata.Histogram[int64]); chk.True(ok) {
+		chk.Equal(int64(11), size.DataPoints[0].Sum)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	chk := assert.New(t)
+
+	size, ok := contentLength("42", nil)
+	chk.True(ok)
+	chk.Equal(int64(42), size)
+
+	_, ok = contentLength("", nil)
+	chk.False(ok)
+	_, ok = contentLength("-1", nil)
+	chk.False(ok)
+	_, ok = contentLength("lots", nil)
+	chk.False(ok)
+}
@@ -0,0 +1,238 @@
+package kongotel
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type jsonRequest struct {
+	path    string
+	headers http.Header
+	body    map[string]any
+}
+
+// newJSONCollector returns settings for exporting to a collector that
+// passes on what it's sent.
+func newJSONCollector(t *testing.T) (exporterSettings, <-chan jsonRequest) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	requests := make(chan jsonRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == compressionGzip {
+			var err error
+			if body, err = gzip.NewReader(r.Body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		req := jsonRequest{path: r.URL.Path, headers: r.Header}
+		if err := json.NewDecoder(body).Decode(&req.body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- req
+	}))
+	t.Cleanup(collector.Close)
+
+	conf := Config{
+		ExporterOTLPEndpoint:    collector.URL,
+		ExporterOTLPProtocol:    protocolHTTPJSON,
+		ExporterOTLPHeaders:     map[string]string{"Authorization": "Bearer secret"},
+		ExporterOTLPCompression: compressionGzip,
+	}.withDefaults()
+	require.NoError(t, conf.validate())
+	s, err := newExporterSettings(conf)
+	require.NoError(t, err)
+	return s, requests
+}
+
+// field follows a path of keys and indexes through JSON.
+func field(v any, path ...any) any {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, _ := v.(map[string]any)
+			v = m[p]
+		case int:
+			a, _ := v.([]any)
+			if p >= len(a) {
+				return nil
+			}
+			v = a[p]
+		}
+	}
+	return v
+}
+
+func TestJSONExporter_Traces(t *testing.T) {
+	chk := assert.New(t)
+	s, requests := newJSONCollector(t)
+	ctx := context.Background()
+
+	exporter, err := newTraceExporter(ctx, s)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = exporter.Shutdown(ctx) })
+	spans := testSpans(t, "GET /dice")
+	require.NoError(t, exporter.ExportSpans(ctx, spans))
+
+	req := <-requests
+	chk.Equal("/v1/traces", req.path)
+	chk.Equal("application/json", req.headers.Get("Content-Type"))
+	chk.Equal("Bearer secret", req.headers.Get("Authorization"))
+	span := field(req.body, "resourceSpans", 0, "scopeSpans", 0, "spans", 0)
+	chk.Equal("GET /dice", field(span, "name"))
+	// Hex, not base64
+	chk.Equal(spans[0].SpanContext().TraceID().String(), field(span, "traceId"))
+	chk.Equal(spans[0].SpanContext().SpanID().String(), field(span, "spanId"))
+	// Enums are numbers
+	chk.Equal(float64(1), field(span, "kind"))
+	chk.Equal("kong", field(req.body, "resourceSpans", 0, "resource", "attributes", 0, "value", "stringValue"))
+}
+
+func TestJSONExporter_Metrics(t *testing.T) {
+	chk := assert.New(t)
+	s, requests := newJSONCollector(t)
+	ctx := context.Background()
+
+	exporter, err := newMetricExporter(ctx, s)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = exporter.Shutdown(ctx) })
+	now := time.Now()
+	attrs := attribute.NewSet(attribute.String("http.request.method", "GET"))
+	require.NoError(t, exporter.Export(ctx, &metricdata.ResourceMetrics{
+		Resource: resource.NewSchemaless(attribute.String("service.name", "kong")),
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Metrics: []metricdata.Metrics{
+				{
+					Name: "http.server.active_requests",
+					Data: metricdata.Sum[int64]{
+						Temporality: metricdata.CumulativeTemporality,
+						DataPoints:  []metricdata.DataPoint[int64]{{Attributes: attrs, Time: now, Value: 3}},
+					},
+				},
+				{
+					Name: "http.server.request.duration",
+					Unit: "s",
+					Data: metricdata.Histogram[float64]{
+						Temporality: metricdata.CumulativeTemporality,
+						DataPoints: []metricdata.HistogramDataPoint[float64]{{
+							Attributes:   attrs,
+							Time:         now,
+							Count:        2,
+							Sum:          0.5,
+							Bounds:       []float64{0.1, 1},
+							BucketCounts: []uint64{0, 2, 0},
+							Min:          metricdata.NewExtrema(0.2),
+							Max:          metricdata.NewExtrema(0.3),
+							Exemplars: []metricdata.Exemplar[float64]{{
+								Time:    now,
+								Value:   0.3,
+								TraceID: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+								SpanID:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+							}},
+						}},
+					},
+				},
+			},
+		}},
+	}))
+
+	req := <-requests
+	chk.Equal("/v1/metrics", req.path)
+	metrics := field(req.body, "resourceMetrics", 0, "scopeMetrics", 0, "metrics")
+	chk.Equal("http.server.active_requests", field(metrics, 0, "name"))
+	chk.Equal("3", field(metrics, 0, "sum", "dataPoints", 0, "asInt"))
+	chk.Equal(float64(2), field(metrics, 0, "sum", "aggregationTemporality"))
+	histogram := field(metrics, 1, "histogram", "dataPoints", 0)
+	chk.Equal("2", field(histogram, "count"))
+	chk.Equal(float64(0.5), field(histogram, "sum"))
+	chk.Equal(float64(0.2), field(histogram, "min"))
+	chk.Equal("0102030405060708090a0b0c0d0e0f10", field(histogram, "exemplars", 0, "traceId"))
+	chk.Equal("0102030405060708", field(histogram, "exemplars", 0, "spanId"))
+}
+
+func TestJSONExporter_Logs(t *testing.T) {
+	chk := assert.New(t)
+	s, requests := newJSONCollector(t)
+	ctx := context.Background()
+
+	exporter, err := newLogExporter(ctx, s)
+	require.NoError(t, err)
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(exporter)))
+	t.Cleanup(func() { _ = lp.Shutdown(ctx) })
+	var r log.Record
+	r.SetTimestamp(time.Now())
+	r.SetSeverity(log.SeverityError)
+	r.SetBody(log.StringValue("failed to get consumer"))
+	r.AddAttributes(log.Map("error", log.String("type", "pdk")))
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+	lp.Logger(ScopeName).Emit(trace.ContextWithSpanContext(ctx, spanCtx), r)
+
+	req := <-requests
+	chk.Equal("/v1/logs", req.path)
+	record := field(req.body, "resourceLogs", 0, "scopeLogs", 0, "logRecords", 0)
+	chk.Equal("failed to get consumer", field(record, "body", "stringValue"))
+	chk.Equal(float64(17), field(record, "severityNumber"))
+	chk.Equal("pdk", field(record, "attributes", 0, "value", "kvlistValue", "values", 0, "value", "stringValue"))
+	chk.Equal("0102030405060708090a0b0c0d0e0f10", field(record, "traceId"))
+	chk.Equal("0102030405060708", field(record, "spanId"))
+}
+
+func TestJSONExporter_Failed(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(collector.Close)
+
+	s, err := newExporterSettings(Config{
+		ExporterOTLPEndpoint: collector.URL + "/otlp/traces",
+		ExporterOTLPProtocol: protocolHTTPJSON,
+	})
+	require.NoError(t, err)
+	client := newJSONClient(s, "traces")
+	assert.Equal(t, collector.URL+"/otlp/traces", client.url, "the endpoint's own path")
+
+	ctx := context.Background()
+	exporter, err := newTraceExporter(ctx, s)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = exporter.Shutdown(ctx) })
+	err = exporter.ExportSpans(ctx, testSpans(t, "span"))
+	if assert.Error(t, err) {
+		assert.Equal(t, "401", exportErrorType(err))
+	}
+}
+
+func TestJSONExporter_Env(t *testing.T) {
+	chk := assert.New(t)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "https://collector:4318/otlp")
+	t.Setenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT", "https://logs:4318")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "env=yes")
+	t.Setenv("OTEL_EXPORTER_OTLP_COMPRESSION", "gzip")
+
+	s, err := newExporterSettings(Config{ExporterOTLPProtocol: protocolHTTPJSON}.withDefaults())
+	require.NoError(t, err)
+	traces := newJSONClient(s, "traces")
+	chk.Equal("https://collector:4318/otlp/v1/traces", traces.url)
+	chk.Equal(map[string]string{"env": "yes"}, traces.headers)
+	chk.True(traces.gzip)
+	chk.Equal("https://logs:4318", newJSONClient(s, "logs").url, "a signal's own endpoint is used as it is")
+}
@@ -0,0 +1,169 @@
+package kongotel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/bridge"
+	"github.com/Kong/go-pdk/server/kong_plugin_protocol"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// pdkRPCSystem identifies Kong's plugin server protocol in rpc.system
+const pdkRPCSystem = "kong_pdk"
+
+// TracePDK returns a PDK that starts an internal span for every call it
+// makes to Kong, as children of the span in ctx.
+//
+// It gives the PDK a connection that passes each call on to kong's bridge,
+// so nothing needs wrapping per PDK method. go-pdk's bridge is a struct
+// around its connection, so the connection is the one place to hook in,
+// and it has to speak go-pdk's framing: go.mod pins go-pdk to the version
+// that TestTracePDK_RecordedFrames recorded.
+func TracePDK(ctx context.Context, kong *pdk.PDK) *pdk.PDK {
+	return pdk.Init(&tracedConn{
+		bridge: kong.Request.PdkBridge,
+		ctx:    ctx,
+		tracer: getTracer(trace.SpanFromContext(ctx)),
+	})
+}
+
+// replyErrors pick out the errors that Kong gives in the replies to some
+// calls, rather than by failing them. In go-pdk v0.10.0 that's only
+// get_raw_body; other calls fail on replies that don't unmarshal, which
+// ask catches as the PDK would.
+var replyErrors = map[string]func(reply []byte) error{
+	"kong.request.get_raw_body": func(reply []byte) error {
+		var body kong_plugin_protocol.RawBodyResult
+		if err := proto.Unmarshal(reply, &body); err != nil {
+			return err
+		}
+		if e, ok := body.Kind.(*kong_plugin_protocol.RawBodyResult_Error); ok {
+			return errors.New(e.Error)
+		}
+		return nil
+	},
+}
+
+// tracedConn is the connection of a PDK that makes its calls with another
+// PDK's bridge. Frames are a little-endian uint32 length followed by that
+// many bytes. Once the method and args of a call have been written, it is
+// made with bridge, in a span, and the reply waits to be read.
+// The PDK makes one call at a time.
+type tracedConn struct {
+	bridge bridge.PdkBridge
+	ctx    context.Context
+	tracer trace.Tracer
+
+	// frames holds the frames written for the current call
+	frames [][]byte
+	wbuf   []byte
+	// rbuf holds the framed reply, or err the failure, until it's read
+	rbuf []byte
+	err  error
+}
+
+func (c *tracedConn) Write(b []byte) (int, error) {
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= 4 {
+		size := int(binary.LittleEndian.Uint32(c.wbuf))
+		if len(c.wbuf) < 4+size {
+			break
+		}
+		c.frames = append(c.frames, c.wbuf[4:4+size])
+		c.wbuf = c.wbuf[4+size:]
+		if len(c.frames) == 2 {
+			c.call(string(c.frames[0]), c.frames[1])
+			c.frames = nil
+		}
+	}
+	if len(c.wbuf) == 0 {
+		c.wbuf = nil
+	}
+	return len(b), nil
+}
+
+func (c *tracedConn) Read(b []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		err := c.err
+		c.err = nil
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// call makes the call with the bridge, which takes messages rather than
+// frames. Messages of an unknown type keep their fields, so the args and
+// reply pass through an Empty unchanged.
+func (c *tracedConn) call(method string, args []byte) {
+	_, span := c.tracer.Start(c.ctx, method,
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String(pdkRPCSystem),
+			semconv.RPCMethod(method),
+		))
+	defer span.End()
+
+	reply, err := c.ask(method, args)
+	if err == nil {
+		if replyError, ok := replyErrors[method]; ok {
+			// The PDK returns these as errors too
+			recordError(span, replyError(reply))
+		}
+		c.rbuf = binary.LittleEndian.AppendUint32(nil, uint32(len(reply)))
+		c.rbuf = append(c.rbuf, reply...)
+		return
+	}
+	recordError(span, err)
+	c.err = err
+}
+
+func (c *tracedConn) ask(method string, args []byte) ([]byte, error) {
+	in := new(emptypb.Empty)
+	if err := proto.Unmarshal(args, in); err != nil {
+		return nil, err
+	}
+	// An unreadable reply fails the Ask, as it would the PDK's own
+	out := new(emptypb.Empty)
+	if err := c.bridge.Ask(method, in, out); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(out)
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Close closes the bridge, as happens after kong.response.exit.
+func (c *tracedConn) Close() error {
+	return c.bridge.Close()
+}
+
+// The bridge only reads, writes and closes its connection.
+func (*tracedConn) LocalAddr() net.Addr              { return pdkAddr{} }
+func (*tracedConn) RemoteAddr() net.Addr             { return pdkAddr{} }
+func (*tracedConn) SetDeadline(time.Time) error      { return nil }
+func (*tracedConn) SetReadDeadline(time.Time) error  { return nil }
+func (*tracedConn) SetWriteDeadline(time.Time) error { return nil }
+
+type pdkAddr struct{}
+
+func (pdkAddr) Network() string { return pdkRPCSystem }
+func (pdkAddr) String() string  { return "kong" }
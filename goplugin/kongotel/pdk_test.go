@@ -0,0 +1,216 @@
+package kongotel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"runtime/debug"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/Kong/go-pdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestTracePDK(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		ctx, span := otel.Tracer("test").Start(ctx, "parent")
+		defer span.End()
+
+		kong = TracePDK(ctx, kong)
+		host, err := kong.Request.GetHeader("host")
+		chk.NoError(err)
+		chk.Equal("localhost", host)
+		_, err = kong.Request.GetHeaders(-1)
+		chk.NoError(err)
+		chk.NoError(kong.Response.SetHeader("x-test", "yes"))
+		kong.Response.ExitStatus(204)
+	}
+	env.DoAccess(mkTestNew(context.Background(), access)())
+	chk.Equal(204, env.ClientRes.Status)
+
+	if chk.Len(*exporter.spans, 5) {
+		parent := (*exporter.spans)[4]
+		names := []string{}
+		for _, span := range (*exporter.spans)[:4] {
+			names = append(names, span.Name())
+			chk.Equal(parent.SpanContext().SpanID(), span.Parent().SpanID())
+			chk.Contains(span.Attributes(), semconv.RPCSystemKey.String(pdkRPCSystem))
+			chk.Contains(span.Attributes(), semconv.RPCMethod(span.Name()))
+			chk.Equal(codes.Unset, span.Status().Code)
+		}
+		chk.Equal([]string{
+			"kong.request.get_header", "kong.request.get_headers",
+			"kong.response.set_header", "kong.response.exit",
+		}, names)
+	}
+}
+
+func TestTracePDK_ConnectionError(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	conn, kongSide := net.Pipe()
+	go func() {
+		// Read the method and args, then hang up without replying
+		for i := 0; i < 2; i++ {
+			var size uint32
+			if binary.Read(kongSide, binary.LittleEndian, &size) != nil {
+				return
+			}
+			_, _ = io.CopyN(io.Discard, kongSide, int64(size))
+		}
+		kongSide.Close()
+	}()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "parent")
+	kong := TracePDK(ctx, pdk.Init(conn))
+	_, err := kong.Request.GetMethod()
+	chk.Error(err)
+	span.End()
+
+	if chk.Len(*exporter.spans, 2) {
+		call := (*exporter.spans)[0]
+		chk.Equal("kong.request.get_method", call.Name())
+		chk.Equal(codes.Error, call.Status().Code)
+		chk.Len(call.Events(), 1)
+	}
+}
+
+func TestTracePDK_ReplyError(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+	})
+	chk.NoError(err)
+	env.Failing["kong.request.get_path"] = true
+
+	access := func(ctx context.Context, kong *pdk.PDK) {
+		ctx, span := otel.Tracer("test").Start(ctx, "parent")
+		defer span.End()
+
+		kong = TracePDK(ctx, kong)
+		_, err := kong.Request.GetPath()
+		chk.Error(err)
+		method, err := kong.Request.GetMethod()
+		chk.NoError(err, "the bridge is still usable")
+		chk.Equal("GET", method)
+	}
+	env.DoAccess(mkTestNew(context.Background(), access)())
+
+	if chk.Len(*exporter.spans, 3) {
+		call := (*exporter.spans)[0]
+		chk.Equal("kong.request.get_path", call.Name())
+		chk.Equal(codes.Error, call.Status().Code)
+		chk.Len(call.Events(), 1)
+		chk.Equal(codes.Unset, (*exporter.spans)[1].Status().Code)
+	}
+}
+
+// recordedPDKVersion is the go-pdk that the frames below were recorded
+// from, which tracedConn relies on speaking the same framing as.
+const recordedPDKVersion = "v0.10.0"
+
+// recordedCalls are PDK calls as go-pdk frames them: a little-endian
+// uint32 length, then the method, the args and Kong's reply.
+var recordedCalls = []struct {
+	method      string
+	args, reply string
+}{
+	// get_header("host"), to "localhost"
+	{"kong.request.get_header", "060000000a04686f7374", "0b0000000a096c6f63616c686f7374"},
+	// An error Kong gives in the reply
+	{"kong.request.get_raw_body", "00000000", "5e0000001a5c7265717565737420626f647920646964206e6f742066697420696e746f20636c69656e7420626f6479206275666665722c20636f6e73696465722072616973696e672027636c69656e745f626f64795f6275666665725f73697a6527"},
+	// A reply the PDK can't read: an Int whose varint is cut off
+	{"kong.request.get_port", "00000000", "0100000008"},
+	// "GET"
+	{"kong.request.get_method", "00000000", "050000000a03474554"},
+}
+
+func TestTracePDK_RecordedFrames(t *testing.T) {
+	chk := assert.New(t)
+	info, ok := debug.ReadBuildInfo()
+	require.True(t, ok)
+	version := ""
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/Kong/go-pdk" {
+			version = dep.Version
+		}
+	}
+	require.Equal(t, recordedPDKVersion, version, "record the frames again for the new go-pdk")
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	conn, kongSide := net.Pipe()
+	t.Cleanup(func() { kongSide.Close() })
+	go func() {
+		for _, call := range recordedCalls {
+			method := binary.LittleEndian.AppendUint32(nil, uint32(len(call.method)))
+			method = append(method, call.method...)
+			args, _ := hex.DecodeString(call.args)
+			for _, want := range [][]byte{method, args} {
+				got := make([]byte, len(want))
+				if _, err := io.ReadFull(kongSide, got); err != nil || !bytes.Equal(want, got) {
+					t.Errorf("%s: got frame %x, want %x", call.method, got, want)
+					kongSide.Close()
+					return
+				}
+			}
+			reply, _ := hex.DecodeString(call.reply)
+			if _, err := kongSide.Write(reply); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "parent")
+	kong := TracePDK(ctx, pdk.Init(conn))
+	host, err := kong.Request.GetHeader("host")
+	chk.NoError(err)
+	chk.Equal("localhost", host)
+	_, err = kong.Request.GetRawBody()
+	chk.ErrorContains(err, "client_body_buffer_size")
+	_, err = kong.Request.GetPort()
+	chk.Error(err)
+	method, err := kong.Request.GetMethod()
+	chk.NoError(err, "the bridge is still usable")
+	chk.Equal("GET", method)
+	span.End()
+
+	if chk.Len(*exporter.spans, 5) {
+		for i, want := range []codes.Code{codes.Unset, codes.Error, codes.Error, codes.Unset} {
+			call := (*exporter.spans)[i]
+			chk.Equal(recordedCalls[i].method, call.Name())
+			chk.Equal(want, call.Status().Code, call.Name())
+		}
+		chk.Contains((*exporter.spans)[1].Status().Description, "client_body_buffer_size")
+	}
+}
@@ -0,0 +1,248 @@
+package kongotel
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kong/go-pdk"
+)
+
+// NewPlugin wraps the constructor of a plugin's config so that its
+// instances are instrumented, much like otelhttp.NewHandler does for an
+// http.Handler. Each request gets a server span, with a span for each
+// phase of the plugin around calls to the plugin's own phase methods.
+//
+// The wrapped instances also take an "otel" record in their config, which
+// configures t. If t is nil the global providers are used as they are.
+func NewPlugin(ctx context.Context, t *Telemetry, constructor func() interface{}) func() interface{} {
+	var generation atomic.Uint64
+	return func() interface{} {
+		return &plugin{
+			config:     constructor(),
+			ctx:        ctx,
+			telemetry:  t,
+			generation: generation.Add(1),
+		}
+	}
+}
+
+// plugin is an instrumented plugin instance.
+// Kong only runs the phases that the -dump says the plugin has, which are
+// those of the wrapped config plus the ones needed to trace requests.
+type plugin struct {
+	config interface{}
+	otel   Config
+	opts   requestOptions
+
+	ctx       context.Context
+	telemetry *Telemetry
+	// generation orders instances by when Kong started them
+	generation uint64
+}
+
+// UnmarshalJSON decodes Kong's config for the instance into both the
+// wrapped config and our otel record.
+func (p *plugin) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, p.config); err != nil {
+		return err
+	}
+	var conf struct {
+		OTel Config `json:"otel"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+	p.otel = conf.OTel
+	p.opts = newRequestOptions(p.otel)
+	return nil
+}
+
+// configureTelemetry makes sure the SDK is set up, with the latest
+// configuration, before we start any spans.
+func (p *plugin) configureTelemetry(kong *pdk.PDK) {
+	if err := p.telemetry.configure(p.otel, p.generation, kong.Node.GetId); err != nil {
+		LogError(p.ctx, kong, err)
+	}
+}
+
+// call runs one of the wrapped config's phase methods within ctx.
+func (p *plugin) call(ctx context.Context, kong *pdk.PDK, phase func(*pdk.PDK)) {
+	if p.otel.TracePDKCalls {
+		kong = TracePDK(ctx, kong)
+	}
+	active.Store(kong, ctx)
+	defer active.Delete(kong)
+	phase(kong)
+}
+
+// active holds the context of each phase method in progress, by the PDK
+// it was given, for Context.
+var active sync.Map
+
+// Context returns the context of the plugin's current phase, with its
+// span, for a phase method of an instrumented plugin to start spans or log
+// with. kong is the PDK the phase method was given.
+func Context(kong *pdk.PDK) context.Context {
+	if ctx, ok := active.Load(kong); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+func (p *plugin) Certificate(kong *pdk.PDK) {
+	defer p.telemetry.startPhase()()
+	if h, ok := p.config.(interface{ Certificate(*pdk.PDK) }); ok {
+		h.Certificate(kong)
+	}
+}
+
+func (p *plugin) Preread(kong *pdk.PDK) {
+	defer p.telemetry.startPhase()()
+	if h, ok := p.config.(interface{ Preread(*pdk.PDK) }); ok {
+		h.Preread(kong)
+	}
+}
+
+func (p *plugin) Rewrite(kong *pdk.PDK) {
+	defer p.telemetry.startPhase()()
+	p.configureTelemetry(kong)
+	h, hasRewrite := p.config.(interface{ Rewrite(*pdk.PDK) })
+
+	rt, err := requests.begin(p.ctx, kong, p.telemetry, p.opts)
+	if err != nil {
+		// Telemetry isn't worth failing the request over
+		LogError(p.ctx, kong, err)
+		if hasRewrite {
+			p.call(p.ctx, kong, h.Rewrite)
+		}
+		return
+	}
+	// So the client gets it even if a rewrite phase exits
+	p.setTraceResponse(rt, kong)
+	ctx, span := rt.startPhase("Rewrite")
+	defer span.End()
+	if hasRewrite {
+		p.call(ctx, kong, h.Rewrite)
+	}
+}
+
+func (p *plugin) Access(kong *pdk.PDK) {
+	defer p.telemetry.startPhase()()
+	p.configureTelemetry(kong)
+	h, hasAccess := p.config.(interface{ Access(*pdk.PDK) })
+
+	rt, err := requests.begin(p.ctx, kong, p.telemetry, p.opts)
+	if err != nil {
+		LogError(p.ctx, kong, err)
+		if hasAccess {
+			p.call(p.ctx, kong, h.Access)
+		}
+		return
+	}
+	if !rt.routed {
+		// It began in the rewrite phase, before Kong had routed it
+		rt.setRoute(kong)
+	}
+	if ctx, err := p.opts.addConsumerBaggage(rt.ctx, kong); err != nil {
+		LogError(rt.ctx, kong, err)
+	} else {
+		rt.ctx = ctx
+	}
+	// Before the plugin's Access, which may make its own calls upstream
+	if err := p.opts.injectUpstream(rt.ctx, kong, rt.continued); err != nil {
+		LogError(rt.ctx, kong, err)
+	}
+	p.setTraceResponse(rt, kong)
+	ctx, span := rt.startPhase("Access")
+	defer span.End()
+	if hasAccess {
+		p.call(ctx, kong, h.Access)
+	}
+}
+
+// setTraceResponse sets the trace response header in the first phase of
+// the request that can: Rewrite for global plugins, and Access otherwise.
+func (p *plugin) setTraceResponse(rt *requestTelemetry, kong *pdk.PDK) {
+	if _, ok := TraceResponse(rt.ctx); ok {
+		return
+	}
+	if ctx, err := p.opts.setTraceResponse(rt.ctx, kong); err != nil {
+		LogError(rt.ctx, kong, err)
+	} else {
+		rt.ctx = ctx
+	}
+}
+
+func (p *plugin) Response(kong *pdk.PDK) {
+	defer p.telemetry.startPhase()()
+	h, hasResponse := p.config.(interface{ Response(*pdk.PDK) })
+
+	rt, ok := requests.lookup(kong)
+	if !ok {
+		if hasResponse {
+			p.call(p.ctx, kong, h.Response)
+		}
+		return
+	}
+	ctx, span := rt.startPhase("Response")
+	defer span.End()
+
+	// The log phase overwrites this with what the client was sent,
+	// but until then the upstream's status is the best we have.
+	if status, err := kong.ServiceResponse.GetStatus(); err != nil {
+		RecordPDKError(span, "kong.service.response.get_status", err)
+		LogError(ctx, kong, err)
+	} else {
+		setResponseStatus(rt.span, status)
+	}
+
+	if hasResponse {
+		p.call(ctx, kong, h.Response)
+	}
+}
+
+// Log runs for every request, including those that exited early,
+// so this is where the server span ends, and where the SDK's errors are
+// logged.
+func (p *plugin) Log(kong *pdk.PDK) {
+	defer p.telemetry.startPhase()()
+	h, hasLog := p.config.(interface{ Log(*pdk.PDK) })
+	defer p.telemetry.logErrors(kong)
+
+	rt, ok := requests.finish(kong)
+	if !ok {
+		if hasLog {
+			p.call(p.ctx, kong, h.Log)
+		}
+		return
+	}
+	ctx, span := rt.startPhase("Log")
+	defer rt.end()
+	defer span.End()
+
+	if hasLog {
+		p.call(ctx, kong, h.Log)
+	}
+
+	status, err := kong.Response.GetStatus()
+	if err != nil {
+		RecordPDKError(rt.span, "kong.response.get_status", err)
+		LogError(ctx, kong, err)
+		status = 0
+	} else {
+		setResponseStatus(rt.span, status)
+	}
+	if err := p.opts.capture.captureResponse(kong, rt.span); err != nil {
+		RecordPDKError(rt.span, "kong.response.get_headers", err)
+		LogError(ctx, kong, err)
+	}
+	if consumer, err := kong.Client.GetConsumer(); err == nil && consumer.Id != "" {
+		rt.span.SetAttributes(kongConsumerIDKey.String(consumer.Id))
+	}
+	promoted := promotedBaggage(rt.ctx, p.opts.baggageAttributes)
+	rt.span.SetAttributes(promoted...)
+	rt.metrics.recordRequest(ctx, kong, rt.method, rt.scheme, rt.routeAttrs, status, time.Since(rt.startTime), promoted...)
+}
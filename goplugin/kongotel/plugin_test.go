@@ -0,0 +1,105 @@
+package kongotel
+
+import (
+	"context"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/Kong/go-pdk"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// helloPlugin is a plugin to instrument, like goplugin's own.
+type helloPlugin struct {
+	Message string `json:"message"`
+	Timeout int    `json:"timeout_ms"`
+}
+
+func (conf helloPlugin) Access(kong *pdk.PDK) {
+	ctx := Context(kong)
+	span := trace.SpanFromContext(ctx)
+
+	host, err := kong.Request.GetHeader("Host")
+	if err != nil {
+		RecordPDKError(span, "kong.request.get_header", err)
+		LogError(ctx, kong, err)
+	}
+	err = kong.Response.SetHeader("x-hello", host)
+	if err != nil {
+		RecordPDKError(span, "kong.response.set_header", err)
+		LogError(ctx, kong, err)
+	}
+}
+
+func newTestPlugin() *plugin {
+	New := NewPlugin(context.Background(), nil, func() interface{} {
+		return &helloPlugin{}
+	})
+	return New().(*plugin)
+}
+
+// phasePlugin records what it saw in each of its phases.
+type phasePlugin struct {
+	phases []string
+	spans  []trace.SpanContext
+}
+
+func (p *phasePlugin) seen(phase string, kong *pdk.PDK) {
+	p.phases = append(p.phases, phase)
+	p.spans = append(p.spans, trace.SpanContextFromContext(Context(kong)))
+}
+
+func (p *phasePlugin) Rewrite(kong *pdk.PDK)  { p.seen("rewrite", kong) }
+func (p *phasePlugin) Access(kong *pdk.PDK)   { p.seen("access", kong) }
+func (p *phasePlugin) Response(kong *pdk.PDK) { p.seen("response", kong) }
+func (p *phasePlugin) Log(kong *pdk.PDK)      { p.seen("log", kong) }
+
+func TestPlugin_CallsPhases(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	inner := &phasePlugin{}
+	New := NewPlugin(context.Background(), nil, func() interface{} { return inner })
+	env.DoHttp(New())
+
+	chk.Equal([]string{"rewrite", "access", "response", "log"}, inner.phases)
+	if chk.Len(*exporter.spans, 5) {
+		byName := map[string]trace.SpanContext{}
+		for _, span := range *exporter.spans {
+			byName[span.Name()] = span.SpanContext()
+		}
+		for i, phase := range []string{"Rewrite", "Access", "Response", "Log"} {
+			chk.Equal(byName[phase], inner.spans[i], "%s is given its phase span", phase)
+		}
+	}
+}
+
+func TestPlugin_NoPhases(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+	})
+	chk.NoError(err)
+
+	New := NewPlugin(context.Background(), nil, func() interface{} { return &struct{}{} })
+	env.DoHttp(New())
+
+	chk.Equal(200, env.ClientRes.Status)
+	chk.Len(*exporter.spans, 5, "still traced")
+}
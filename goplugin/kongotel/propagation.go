@@ -0,0 +1,137 @@
+package kongotel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Propagation modes, after the header_type of Kong's opentelemetry plugin.
+const (
+	// propagationInject continues the client's trace, and passes our span
+	// on to the upstream.
+	propagationInject = "inject"
+	// propagationPreserve continues the client's trace, but leaves the
+	// upstream's headers as the client sent them.
+	propagationPreserve = "preserve"
+	// propagationIgnore starts a new trace whatever the client sent, and
+	// replaces the client's headers with ours for the upstream.
+	propagationIgnore = "ignore"
+)
+
+// defaultPropagators are the W3C formats, as for OTEL_PROPAGATORS.
+var defaultPropagators = []string{"tracecontext", "baggage"}
+
+// splitPropagator reads one set of formats, and writes another, so that
+// e.g. clients sending B3 can be traced while the upstream gets W3C
+// headers.
+type splitPropagator struct {
+	extract, inject propagation.TextMapPropagator
+}
+
+func (p splitPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	p.inject.Inject(ctx, carrier)
+}
+
+// Extract tries each format in turn, so the last one the client sent wins.
+func (p splitPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return p.extract.Extract(ctx, carrier)
+}
+
+// Fields are those of both sets, which are the headers the ignore mode
+// clears.
+func (p splitPropagator) Fields() []string {
+	fields := p.inject.Fields()
+	seen := map[string]bool{}
+	for _, f := range fields {
+		seen[f] = true
+	}
+	for _, f := range p.extract.Fields() {
+		if !seen[f] {
+			seen[f] = true
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func validatePropagation(mode string) error {
+	switch mode {
+	case "", propagationInject, propagationPreserve, propagationIgnore:
+		return nil
+	}
+	return fmt.Errorf("propagation must be %q, %q or %q, got %q",
+		propagationInject, propagationPreserve, propagationIgnore, mode)
+}
+
+// requestOptions are the settings of a plugin instance that apply to each
+// request it traces. The zero value is the default.
+type requestOptions struct {
+	propagation       string
+	capture           *capture
+	baggageAttributes []string
+	consumerBaggage   map[string]string
+	// traceResponseHeader is empty if it's not wanted
+	traceResponseHeader string
+	// samplingDeferred is whether spans may be kept or dropped after the
+	// head sampling decision, by the sampling rules or tail sampling
+	samplingDeferred bool
+	trust            trustPolicy
+}
+
+func newRequestOptions(conf Config) requestOptions {
+	return requestOptions{
+		propagation:         conf.Propagation,
+		capture:             newCapture(conf),
+		baggageAttributes:   conf.BaggageAttributes,
+		consumerBaggage:     conf.ConsumerBaggage,
+		traceResponseHeader: conf.TraceResponseHeader,
+		samplingDeferred:    conf.Sampler == samplerRules || conf.TailSampling.enabled(),
+		trust:               conf.Trust,
+	}
+}
+
+// extracts is whether the server span continues the client's trace.
+func (o requestOptions) extracts() bool {
+	return o.propagation != propagationIgnore
+}
+
+// injectUpstream sets the trace context of ctx, i.e. traceparent,
+// tracestate and baggage, on the request to the upstream, so that its
+// spans are children of ours.
+// Kong's opentelemetry plugin runs before us and sets its own, so ours win.
+// The headers of clients whose context we didn't continue are cleared.
+// A failure is recorded on the span of ctx.
+func (o requestOptions) injectUpstream(ctx context.Context, kong *pdk.PDK, continued bool) error {
+	if o.propagation == propagationPreserve {
+		return nil
+	}
+	propagator := otel.GetTextMapPropagator()
+	carrier := propagation.HeaderCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	for _, name := range sortedKeys(carrier) {
+		if err := kong.ServiceRequest.SetHeader(name, carrier.Get(name)); err != nil {
+			RecordPDKError(trace.SpanFromContext(ctx), "kong.service.request.set_header", err)
+			return err
+		}
+	}
+	if continued {
+		return nil
+	}
+	// We didn't read them, so don't pass them on either
+	for _, field := range propagator.Fields() {
+		if carrier.Get(field) != "" {
+			continue
+		}
+		if err := kong.ServiceRequest.ClearHeader(field); err != nil {
+			RecordPDKError(trace.SpanFromContext(ctx), "kong.service.request.clear_header", err)
+			return err
+		}
+	}
+	return nil
+}
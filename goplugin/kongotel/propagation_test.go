@@ -0,0 +1,146 @@
+package kongotel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectUpstream(t *testing.T) {
+	const clientTraceID = "f68de45b0b36ac1c97c2a43166c9cb8f"
+
+	for _, tc := range []struct {
+		mode string
+		// continues is whether the client's trace is continued
+		continues bool
+		// injects is whether the upstream gets our span
+		injects bool
+		baggage string
+	}{
+		{"", true, true, "user=jon"},
+		{propagationInject, true, true, "user=jon"},
+		{propagationPreserve, true, false, "user=jon"},
+		{propagationIgnore, false, true, ""},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			chk := assert.New(t)
+
+			exporter := NewFakeExporter()
+			setupOTEL(t, exporter)
+			otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+				propagation.TraceContext{}, propagation.Baggage{},
+			))
+
+			traceparent := "00-" + clientTraceID + "-9a94fd01ca53f63d-01"
+			env, err := test.New(t, test.Request{
+				Method: "GET",
+				Url:    "http://example.com/plugin",
+				Headers: map[string][]string{
+					"traceparent": {traceparent},
+					"baggage":     {"user=jon"},
+				},
+			})
+			chk.NoError(err)
+
+			New := NewPlugin(context.Background(), nil, func() interface{} { return &helloPlugin{} })
+			conf := New().(*plugin)
+			chk.NoError(conf.UnmarshalJSON([]byte(`{"otel": {"propagation": "` + tc.mode + `"}}`)))
+			env.DoHttp(conf)
+
+			if !chk.Len(*exporter.spans, 5) {
+				return
+			}
+			serverSpan := (*exporter.spans)[4]
+			chk.Equal(tc.continues, serverSpan.SpanContext().TraceID().String() == clientTraceID)
+
+			upstream := otel.GetTextMapPropagator().Extract(context.Background(),
+				propagation.HeaderCarrier(env.ServiceReq.Headers))
+			if tc.injects {
+				chk.Equal(serverSpan.SpanContext().SpanID(), trace.SpanContextFromContext(upstream).SpanID())
+				chk.Equal(serverSpan.SpanContext().TraceID(), trace.SpanContextFromContext(upstream).TraceID())
+			} else {
+				chk.Equal(traceparent, env.ServiceReq.Headers.Get("traceparent"))
+			}
+			chk.Equal(tc.baggage, env.ServiceReq.Headers.Get("baggage"))
+		})
+	}
+}
+
+func TestExtraction_Formats(t *testing.T) {
+	const (
+		traceID = "80f198ee56343ba864fe8b2a57d3eff7"
+		spanID  = "e457b5a2e4d86bd1"
+	)
+	for _, tc := range []struct {
+		format  string
+		headers http.Header
+		// injected is the header the format writes
+		injected string
+	}{
+		{"tracecontext", http.Header{
+			"Traceparent": {"00-" + traceID + "-" + spanID + "-01"},
+		}, "traceparent"},
+		{"b3", http.Header{
+			"B3": {traceID + "-" + spanID + "-1"},
+		}, "b3"},
+		{"b3multi", http.Header{
+			"X-B3-Traceid": {traceID},
+			"X-B3-Spanid":  {spanID},
+			"X-B3-Sampled": {"1"},
+		}, "x-b3-traceid"},
+		{"jaeger", http.Header{
+			"Uber-Trace-Id": {traceID + ":" + spanID + ":0:1"},
+		}, "uber-trace-id"},
+		{"xray", http.Header{
+			"X-Amzn-Trace-Id": {"Root=1-80f198ee-56343ba864fe8b2a57d3eff7;Parent=" + spanID + ";Sampled=1"},
+		}, "X-Amzn-Trace-Id"},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			chk := assert.New(t)
+
+			conf := Config{PropagatorsExtract: []string{tc.format}}.withDefaults()
+			propagator, err := newPropagator(conf)
+			chk.NoError(err)
+
+			ctx := propagator.Extract(context.Background(), propagation.HeaderCarrier(tc.headers))
+			sc := trace.SpanContextFromContext(ctx)
+			chk.Equal(traceID, sc.TraceID().String())
+			chk.Equal(spanID, sc.SpanID().String())
+			chk.True(sc.IsSampled())
+			chk.True(sc.IsRemote())
+
+			// Only the W3C formats are injected by default
+			carrier := http.Header{}
+			propagator.Inject(ctx, propagation.HeaderCarrier(carrier))
+			chk.Equal("00-"+traceID+"-"+spanID+"-01", carrier.Get("traceparent"))
+
+			conf = Config{PropagatorsInject: []string{tc.format}}.withDefaults()
+			propagator, err = newPropagator(conf)
+			chk.NoError(err)
+			carrier = http.Header{}
+			propagator.Inject(ctx, propagation.HeaderCarrier(carrier))
+			chk.NotEmpty(carrier.Get(tc.injected))
+			chk.Contains(propagator.Fields(), "traceparent", "fields to extract")
+		})
+	}
+}
+
+func TestNewPropagator_Unknown(t *testing.T) {
+	_, err := newPropagator(Config{PropagatorsExtract: []string{"smoke-signals"}}.withDefaults())
+	assert.Error(t, err)
+	assert.Error(t, Config{PropagatorsInject: []string{"smoke-signals"}}.validate())
+}
+
+func TestValidatePropagation(t *testing.T) {
+	for _, mode := range []string{"", "inject", "preserve", "ignore"} {
+		assert.NoError(t, validatePropagation(mode), mode)
+	}
+	assert.Error(t, validatePropagation("b3"))
+}
@@ -0,0 +1,347 @@
+package kongotel
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Sampler names, as used by OTEL_TRACES_SAMPLER, plus our own "rules".
+const (
+	samplerAlwaysOn                = "always_on"
+	samplerAlwaysOff               = "always_off"
+	samplerTraceIDRatio            = "traceidratio"
+	samplerParentBasedAlwaysOn     = "parentbased_always_on"
+	samplerParentBasedAlwaysOff    = "parentbased_always_off"
+	samplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+	samplerRules                   = "rules"
+)
+
+// maxDeferredTraces bounds the traces held back waiting for their
+// response status.
+const maxDeferredTraces = 1024
+
+// samplingRule picks the sampling ratio for requests that match all of its
+// non-empty conditions. The first matching rule wins.
+type samplingRule struct {
+	Route      string `json:"route"`
+	PathPrefix string `json:"path_prefix"`
+	Method     string `json:"method"`
+	// StatusCodes are either exact codes, e.g. "429", or classes, e.g. "5xx"
+	StatusCodes []string `json:"status_codes"`
+	Ratio       *float64 `json:"ratio"`
+}
+
+type statusRange struct{ min, max int }
+
+type compiledRule struct {
+	samplingRule
+	statuses []statusRange
+	sampler  trace.Sampler
+}
+
+func compileRule(r samplingRule) (compiledRule, error) {
+	if r.Ratio == nil || *r.Ratio < 0 || *r.Ratio > 1 {
+		return compiledRule{}, fmt.Errorf("sampling rule %+v: ratio must be between 0 and 1", r)
+	}
+	c := compiledRule{samplingRule: r, sampler: trace.TraceIDRatioBased(*r.Ratio)}
+	for _, s := range r.StatusCodes {
+		var sr statusRange
+		if class, ok := strings.CutSuffix(strings.ToLower(s), "xx"); ok {
+			n, err := strconv.Atoi(class)
+			if err != nil || n < 1 || n > 5 {
+				return compiledRule{}, fmt.Errorf("sampling rule: bad status class %q", s)
+			}
+			sr = statusRange{n * 100, n*100 + 99}
+		} else {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return compiledRule{}, fmt.Errorf("sampling rule: bad status code %q", s)
+			}
+			sr = statusRange{n, n}
+		}
+		c.statuses = append(c.statuses, sr)
+	}
+	return c, nil
+}
+
+// matchesRequest checks the conditions known when the request starts.
+func (r compiledRule) matchesRequest(route, method, path string) bool {
+	return (r.Route == "" || r.Route == route) &&
+		(r.Method == "" || strings.EqualFold(r.Method, method)) &&
+		strings.HasPrefix(path, r.PathPrefix)
+}
+
+func (r compiledRule) matchesStatus(status int) bool {
+	if len(r.statuses) == 0 {
+		return true
+	}
+	for _, sr := range r.statuses {
+		if sr.min <= status && status <= sr.max {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFields picks out what the rules match on from span attributes.
+func requestFields(attrs []attribute.KeyValue) (route, method, path string, status int) {
+	for _, kv := range attrs {
+		switch kv.Key {
+		case kongRouteNameKey:
+			route = kv.Value.AsString()
+		case semconv.HTTPRequestMethodKey:
+			method = kv.Value.AsString()
+		case semconv.URLPathKey:
+			path = kv.Value.AsString()
+		case semconv.HTTPResponseStatusCodeKey:
+			status = int(kv.Value.AsInt64())
+		}
+	}
+	return
+}
+
+// ruleSampler applies samplingRules to new traces. Rules that depend on
+// the response status, or on a route that a global plugin doesn't know yet,
+// can't be decided up front, so requests they might match are recorded
+// without being sampled, and left to the deferredSampler to decide once the
+// server span has ended.
+type ruleSampler struct {
+	rules    []compiledRule
+	fallback trace.Sampler
+}
+
+func newRuleSampler(rules []samplingRule, ratio float64) (*ruleSampler, error) {
+	rs := &ruleSampler{fallback: trace.TraceIDRatioBased(ratio)}
+	for _, r := range rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		rs.rules = append(rs.rules, c)
+	}
+	return rs, nil
+}
+
+// match returns the sampler of the first rule that surely matches a new
+// request, and whether a rule before it might match once more is known.
+// The sampler is nil if the rule that applies depends on the route.
+func (rs *ruleSampler) match(attrs []attribute.KeyValue) (trace.Sampler, bool) {
+	route, method, path, _ := requestFields(attrs)
+	deferred := false
+	for _, r := range rs.rules {
+		// Global plugins start the trace before Kong has routed the request
+		if route == "" && r.Route != "" {
+			if r.matchesRequest(r.Route, method, path) {
+				return nil, true
+			}
+			continue
+		}
+		if !r.matchesRequest(route, method, path) {
+			continue
+		}
+		if len(r.statuses) > 0 {
+			deferred = true
+			continue
+		}
+		return r.sampler, deferred
+	}
+	return rs.fallback, deferred
+}
+
+func (rs *ruleSampler) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	sampler, deferred := rs.match(p.Attributes)
+	if sampler == nil {
+		psc := oteltrace.SpanContextFromContext(p.ParentContext)
+		return trace.SamplingResult{Decision: trace.RecordOnly, Tracestate: psc.TraceState()}
+	}
+	result := sampler.ShouldSample(p)
+	if result.Decision == trace.Drop && deferred {
+		result.Decision = trace.RecordOnly
+	}
+	return result
+}
+
+// decide makes the final decision for a deferred trace once the response
+// status is known. A remote parent that wasn't sampled is followed, unless
+// a status rule matches.
+func (rs *ruleSampler) decide(root trace.ReadOnlySpan) bool {
+	route, method, path, status := requestFields(root.Attributes())
+	parent := root.Parent()
+	unsampled := parent.IsValid() && parent.IsRemote() && !parent.IsSampled()
+	sampler := rs.fallback
+	if unsampled {
+		sampler = trace.NeverSample()
+	}
+	for _, r := range rs.rules {
+		if r.matchesRequest(route, method, path) && r.matchesStatus(status) {
+			if len(r.statuses) > 0 || !unsampled {
+				sampler = r.sampler
+			}
+			break
+		}
+	}
+	result := sampler.ShouldSample(trace.SamplingParameters{
+		ParentContext: context.Background(),
+		TraceID:       root.SpanContext().TraceID(),
+	})
+	return result.Decision == trace.RecordAndSample
+}
+
+func (rs *ruleSampler) Description() string {
+	return fmt.Sprintf("RuleSampler{rules:%d,fallback:%s}", len(rs.rules), rs.fallback.Description())
+}
+
+// unsampledRemoteParent follows a remote parent that wasn't sampled, but
+// still records the requests that a status rule might keep, so the rules
+// can see errors that the caller didn't sample.
+type unsampledRemoteParent struct {
+	rules *ruleSampler
+}
+
+func (u unsampledRemoteParent) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	psc := oteltrace.SpanContextFromContext(p.ParentContext)
+	decision := trace.Drop
+	if _, deferred := u.rules.match(p.Attributes); deferred {
+		decision = trace.RecordOnly
+	}
+	return trace.SamplingResult{Decision: decision, Tracestate: psc.TraceState()}
+}
+
+func (unsampledRemoteParent) Description() string {
+	return "UnsampledRemoteParent"
+}
+
+// followRecordingParent keeps recording the children of deferred spans,
+// so the whole trace is there if the deferredSampler decides to keep it.
+type followRecordingParent struct{}
+
+func (followRecordingParent) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	psc := oteltrace.SpanContextFromContext(p.ParentContext)
+	decision := trace.Drop
+	if oteltrace.SpanFromContext(p.ParentContext).IsRecording() {
+		decision = trace.RecordOnly
+	}
+	return trace.SamplingResult{Decision: decision, Tracestate: psc.TraceState()}
+}
+
+func (followRecordingParent) Description() string {
+	return "FollowRecordingParent"
+}
+
+// deferredSampler is a SpanProcessor that holds back the recorded but
+// unsampled spans of a trace until its local root ends, and then hands
+// them on to next if the rules decide to keep them.
+type deferredSampler struct {
+	rules *ruleSampler
+	next  trace.SpanProcessor
+
+	mu      sync.Mutex
+	pending map[oteltrace.TraceID][]trace.ReadOnlySpan
+}
+
+func newDeferredSampler(rules *ruleSampler, next trace.SpanProcessor) *deferredSampler {
+	return &deferredSampler{
+		rules:   rules,
+		next:    next,
+		pending: map[oteltrace.TraceID][]trace.ReadOnlySpan{},
+	}
+}
+
+func (d *deferredSampler) OnStart(context.Context, trace.ReadWriteSpan) {}
+
+func (d *deferredSampler) OnEnd(s trace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		return
+	}
+	traceID := s.SpanContext().TraceID()
+	isRoot := !s.Parent().IsValid() || s.Parent().IsRemote()
+
+	d.mu.Lock()
+	spans, ok := d.pending[traceID]
+	if !ok && len(d.pending) >= maxDeferredTraces && !isRoot {
+		d.mu.Unlock()
+		return
+	}
+	spans = append(spans, s)
+	if isRoot {
+		delete(d.pending, traceID)
+	} else {
+		d.pending[traceID] = spans
+	}
+	d.mu.Unlock()
+
+	if isRoot && d.rules.decide(s) {
+		for _, span := range spans {
+			d.next.OnEnd(sampledSpan{span})
+		}
+	}
+}
+
+func (d *deferredSampler) Shutdown(context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = map[oteltrace.TraceID][]trace.ReadOnlySpan{}
+	return nil
+}
+
+func (d *deferredSampler) ForceFlush(context.Context) error { return nil }
+
+// sampledSpan marks a deferred span as sampled, now that it has been kept.
+type sampledSpan struct {
+	trace.ReadOnlySpan
+}
+
+func (s sampledSpan) SpanContext() oteltrace.SpanContext {
+	sc := s.ReadOnlySpan.SpanContext()
+	return sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+}
+
+// samplingOptions builds the sampler for conf, with spans going on to next.
+func samplingOptions(conf Config, next trace.SpanProcessor) ([]trace.TracerProviderOption, error) {
+	ratio := 1.0
+	if conf.SamplerRatio != nil {
+		ratio = *conf.SamplerRatio
+	}
+
+	var sampler trace.Sampler
+	switch conf.Sampler {
+	case samplerAlwaysOn:
+		sampler = trace.AlwaysSample()
+	case samplerAlwaysOff:
+		sampler = trace.NeverSample()
+	case samplerTraceIDRatio:
+		sampler = trace.TraceIDRatioBased(ratio)
+	case samplerParentBasedAlwaysOn:
+		sampler = trace.ParentBased(trace.AlwaysSample())
+	case samplerParentBasedAlwaysOff:
+		sampler = trace.ParentBased(trace.NeverSample())
+	case samplerParentBasedTraceIDRatio:
+		sampler = trace.ParentBased(trace.TraceIDRatioBased(ratio))
+	case samplerRules:
+		rs, err := newRuleSampler(conf.SamplingRules, ratio)
+		if err != nil {
+			return nil, err
+		}
+		return []trace.TracerProviderOption{
+			trace.WithSampler(trace.ParentBased(rs,
+				trace.WithRemoteParentNotSampled(unsampledRemoteParent{rs}),
+				trace.WithLocalParentNotSampled(followRecordingParent{}))),
+			trace.WithSpanProcessor(next),
+			trace.WithSpanProcessor(newDeferredSampler(rs, next)),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown sampler %q", conf.Sampler)
+	}
+	return []trace.TracerProviderOption{
+		trace.WithSampler(sampler),
+		trace.WithSpanProcessor(next),
+	}, nil
+}
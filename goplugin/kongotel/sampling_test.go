@@ -0,0 +1,189 @@
+package kongotel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func setupSampledOTEL(t *testing.T, e sdktrace.SpanExporter, conf Config) {
+	ctx := context.TODO()
+
+	opts, err := samplingOptions(conf.withDefaults(), sdktrace.NewSimpleSpanProcessor(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { _ = tp.Shutdown(ctx) })
+}
+
+// doRequest runs a request through the plugin with the upstream
+// responding with status.
+func doRequest(t *testing.T, method, url string, headers http.Header, body []byte, status int) {
+	headers.Set("host", "localhost")
+	env, err := test.New(t, test.Request{Method: method, Url: url, Headers: headers, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := newTestPlugin()
+	conf.otel.TracePDKCalls = true
+	env.DoAccess(conf)
+	env.ServiceRes = test.Response{Status: status, Headers: http.Header{}}
+	env.DoResponse(conf)
+	env.DoLog(conf)
+}
+
+const (
+	sampledParent   = "00-f68de45b0b36ac1c97c2a43166c9cb8f-9a94fd01ca53f63d-01"
+	unsampledParent = "00-f68de45b0b36ac1c97c2a43166c9cb8f-9a94fd01ca53f63d-00"
+)
+
+func TestSampling_Strategies(t *testing.T) {
+	zero := 0.0
+	for _, tc := range []struct {
+		name        string
+		conf        Config
+		traceparent string
+		spans       int
+	}{
+		{"default", Config{}, "", 6},
+		{"default unsampled parent", Config{}, unsampledParent, 0},
+		{"always_off", Config{Sampler: samplerAlwaysOff}, "", 0},
+		{"always_on", Config{Sampler: samplerAlwaysOn}, unsampledParent, 6},
+		{"parentbased_always_off", Config{Sampler: samplerParentBasedAlwaysOff}, "", 0},
+		{"parentbased_always_off sampled parent", Config{Sampler: samplerParentBasedAlwaysOff}, sampledParent, 6},
+		{"traceidratio", Config{Sampler: samplerTraceIDRatio, SamplerRatio: &zero}, sampledParent, 0},
+		{"parentbased_traceidratio", Config{SamplerRatio: &zero}, "", 0},
+		{"parentbased_traceidratio sampled parent", Config{SamplerRatio: &zero}, sampledParent, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter := NewFakeExporter()
+			setupSampledOTEL(t, exporter, tc.conf)
+
+			headers := http.Header{}
+			if tc.traceparent != "" {
+				headers.Set("traceparent", tc.traceparent)
+			}
+			doRequest(t, "GET", "http://example.com/plugin", headers, nil, 200)
+
+			assert.Len(t, *exporter.spans, tc.spans)
+		})
+	}
+}
+
+func TestSampling_Rules(t *testing.T) {
+	none, all := 0.0, 1.0
+	conf := Config{
+		Sampler:      samplerRules,
+		SamplerRatio: &all,
+		SamplingRules: []samplingRule{
+			{StatusCodes: []string{"5xx", "429"}, Ratio: &all},
+			{PathPrefix: "/health", Ratio: &none},
+			{Method: "post", Route: "route_66", Ratio: &none},
+		},
+	}
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		path        string
+		traceparent string
+		status      int
+		spans       int
+	}{
+		{"unmatched", "GET", "/plugin", "", 200, 6},
+		{"health check", "GET", "/health", "", 200, 0},
+		{"failed health check", "GET", "/health", "", 503, 6},
+		{"rate limited health check", "GET", "/health/live", "", 429, 6},
+		{"post to route", "POST", "/plugin", "", 201, 0},
+		{"failed post to route", "POST", "/plugin", "", 500, 6},
+		{"unsampled parent", "GET", "/plugin", unsampledParent, 200, 0},
+		{"failed with unsampled parent", "GET", "/plugin", unsampledParent, 500, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chk := assert.New(t)
+			exporter := NewFakeExporter()
+			setupSampledOTEL(t, exporter, conf)
+
+			var body []byte
+			if tc.method == "POST" {
+				body = []byte("{}")
+			}
+			headers := http.Header{}
+			if tc.traceparent != "" {
+				headers.Set("traceparent", tc.traceparent)
+			}
+			doRequest(t, tc.method, "http://example.com"+tc.path, headers, body, tc.status)
+
+			if chk.Len(*exporter.spans, tc.spans) && tc.spans > 0 {
+				serverSpan := (*exporter.spans)[tc.spans-1]
+				chk.Equal(tc.method+" route_66", serverSpan.Name())
+				chk.Contains(serverSpan.Attributes(), semconv.URLPath(tc.path))
+				for _, span := range *exporter.spans {
+					chk.True(span.SpanContext().IsSampled())
+					chk.Equal(serverSpan.SpanContext().TraceID(), span.SpanContext().TraceID())
+				}
+			}
+		})
+	}
+}
+
+func TestSampling_RulesGlobal(t *testing.T) {
+	none, all := 0.0, 1.0
+	for _, tc := range []struct {
+		name  string
+		rule  samplingRule
+		spans int
+	}{
+		{"route", samplingRule{Route: "route_66", Ratio: &none}, 0},
+		{"other route", samplingRule{Route: "route_67", Ratio: &none}, 5},
+		{"failed on route", samplingRule{Route: "route_66", StatusCodes: []string{"5xx"}, Ratio: &none}, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter := NewFakeExporter()
+			setupSampledOTEL(t, exporter, Config{
+				Sampler:       samplerRules,
+				SamplerRatio:  &all,
+				SamplingRules: []samplingRule{tc.rule},
+			})
+
+			env, err := test.New(t, test.Request{Method: "GET", Url: "http://example.com/plugin"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Kong routes the request after the rewrite phase
+			inner := routingPlugin{env: env, route: env.Route}
+			env.Route = nil
+			New := NewPlugin(context.Background(), nil, func() interface{} { return inner })
+			env.DoHttp(New())
+
+			if assert.Len(t, *exporter.spans, tc.spans) && tc.spans > 0 {
+				assert.Equal(t, "GET route_66", (*exporter.spans)[tc.spans-1].Name())
+			}
+		})
+	}
+}
+
+func TestSampling_BadConfig(t *testing.T) {
+	ratio := 0.5
+	for _, conf := range []Config{
+		{Sampler: "sometimes"},
+		{Sampler: samplerRules, SamplingRules: []samplingRule{{PathPrefix: "/"}}},
+		{Sampler: samplerRules, SamplingRules: []samplingRule{{StatusCodes: []string{"6xx"}, Ratio: &ratio}}},
+		{Sampler: samplerRules, SamplingRules: []samplingRule{{StatusCodes: []string{"five hundred"}, Ratio: &ratio}}},
+	} {
+		_, err := samplingOptions(conf.withDefaults(), sdktrace.NewSimpleSpanProcessor(NewFakeExporter()))
+		assert.Error(t, err, "%+v", conf)
+	}
+}
@@ -0,0 +1,244 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Why spans were dropped, for kongotel.spans.dropped.
+const (
+	// dropQueueFull spans arrived while the batch queue was full
+	dropQueueFull = "queue_full"
+	// dropExportFailed spans were in a batch the collector didn't take,
+	// with no export queue to retry from
+	dropExportFailed = "export_failed"
+)
+
+var dropReasonKey = attribute.Key("kongotel.drop.reason")
+
+// pipelineMetrics are the trace pipeline's metrics about itself, for
+// telling when spans aren't making it to the collector, and why.
+type pipelineMetrics struct {
+	started        metric.Int64Counter
+	ended          metric.Int64Counter
+	exported       metric.Int64Counter
+	dropped        metric.Int64Counter
+	exportDuration metric.Float64Histogram
+
+	// queued counts the spans in the batch span processor. Kong's requests
+	// mustn't wait on the collector, so the processor drops spans when
+	// it's full. We drop them first, to know that we did.
+	queued        atomic.Int64
+	queueCapacity int64
+	// dropCount is the total of dropped, for reporting at shutdown
+	dropCount atomic.Int64
+}
+
+func newPipelineMetrics(mp metric.MeterProvider, queueCapacity int) (*pipelineMetrics, error) {
+	meter := mp.Meter(ScopeName)
+	m := &pipelineMetrics{queueCapacity: int64(queueCapacity)}
+	var err error
+	m.started, err = meter.Int64Counter("kongotel.spans.started",
+		metric.WithDescription("Recording spans started."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return nil, err
+	}
+	m.ended, err = meter.Int64Counter("kongotel.spans.ended",
+		metric.WithDescription("Recording spans ended."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return nil, err
+	}
+	m.exported, err = meter.Int64Counter("kongotel.spans.exported",
+		metric.WithDescription("Spans sent to the collector, with error.type if it didn't take them."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return nil, err
+	}
+	m.dropped, err = meter.Int64Counter("kongotel.spans.dropped",
+		metric.WithDescription("Sampled spans that will never reach the collector."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return nil, err
+	}
+	m.exportDuration, err = meter.Float64Histogram("kongotel.export.duration",
+		metric.WithDescription("Duration of span exports, with error.type if they failed."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	queueSize, err := meter.Int64ObservableGauge("kongotel.batch_queue.size",
+		metric.WithDescription("Spans waiting in the batch queue to be exported."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(queueSize, m.queued.Load())
+		return nil
+	}, queueSize)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *pipelineMetrics) drop(ctx context.Context, n int64, reason string) {
+	m.dropped.Add(ctx, n, metric.WithAttributes(dropReasonKey.String(reason)))
+	m.dropCount.Add(n)
+}
+
+// lost counts the spans dropped, or still queued for export.
+func (m *pipelineMetrics) lost() int64 {
+	return m.dropCount.Load() + m.queued.Load()
+}
+
+// batchQueueSize is the capacity of the batch span processor's queue,
+// which it takes from the environment if the config doesn't say.
+func batchQueueSize(conf Config) int {
+	if conf.BatchMaxQueueSize > 0 {
+		return conf.BatchMaxQueueSize
+	}
+	if n, err := strconv.Atoi(os.Getenv("OTEL_BSP_MAX_QUEUE_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return trace.DefaultMaxQueueSize
+}
+
+// spanCounter is a SpanProcessor that counts the spans started and ended.
+type spanCounter struct {
+	m *pipelineMetrics
+}
+
+func (c spanCounter) OnStart(ctx context.Context, _ trace.ReadWriteSpan) {
+	c.m.started.Add(ctx, 1)
+}
+
+func (c spanCounter) OnEnd(trace.ReadOnlySpan) {
+	c.m.ended.Add(context.Background(), 1)
+}
+
+func (spanCounter) Shutdown(context.Context) error   { return nil }
+func (spanCounter) ForceFlush(context.Context) error { return nil }
+
+// batchQueueGate is a SpanProcessor in front of the batch span processor
+// that counts the spans going into its queue, and drops them when it's
+// full. batchQueueExit counts them out again.
+type batchQueueGate struct {
+	m    *pipelineMetrics
+	next trace.SpanProcessor
+}
+
+func (g batchQueueGate) OnStart(ctx context.Context, s trace.ReadWriteSpan) {
+	g.next.OnStart(ctx, s)
+}
+
+func (g batchQueueGate) OnEnd(s trace.ReadOnlySpan) {
+	if !s.SpanContext().IsSampled() {
+		// The batch span processor ignores these
+		return
+	}
+	if g.m.queued.Add(1) > g.m.queueCapacity {
+		g.m.queued.Add(-1)
+		g.m.drop(context.Background(), 1, dropQueueFull)
+		return
+	}
+	g.next.OnEnd(s)
+}
+
+func (g batchQueueGate) Shutdown(ctx context.Context) error {
+	return g.next.Shutdown(ctx)
+}
+
+func (g batchQueueGate) ForceFlush(ctx context.Context) error {
+	return g.next.ForceFlush(ctx)
+}
+
+// batchQueueExit is the batch span processor's exporter, which counts
+// spans leaving its queue.
+type batchQueueExit struct {
+	m    *pipelineMetrics
+	next trace.SpanExporter
+}
+
+func (e batchQueueExit) ExportSpans(ctx context.Context, spans []trace.ReadOnlySpan) error {
+	e.m.queued.Add(-int64(len(spans)))
+	return e.next.ExportSpans(ctx, spans)
+}
+
+func (e batchQueueExit) Shutdown(ctx context.Context) error {
+	return e.next.Shutdown(ctx)
+}
+
+// measuredExporter times the exports of the OTLP exporter, and counts the
+// spans exported. Unless they'll be retried, the spans in a failed export
+// are dropped.
+type measuredExporter struct {
+	m       *pipelineMetrics
+	next    trace.SpanExporter
+	retried bool
+}
+
+func (e measuredExporter) ExportSpans(ctx context.Context, spans []trace.ReadOnlySpan) error {
+	start := time.Now()
+	err := e.next.ExportSpans(ctx, spans)
+	n := int64(len(spans))
+	if err == nil {
+		e.m.exportDuration.Record(ctx, time.Since(start).Seconds())
+		e.m.exported.Add(ctx, n)
+		return nil
+	}
+	failed := metric.WithAttributes(semconv.ErrorTypeKey.String(exportErrorType(err)))
+	e.m.exportDuration.Record(ctx, time.Since(start).Seconds(), failed)
+	e.m.exported.Add(ctx, n, failed)
+	if !e.retried {
+		e.m.drop(ctx, n, dropExportFailed)
+	}
+	return err
+}
+
+func (e measuredExporter) Shutdown(ctx context.Context) error {
+	return e.next.Shutdown(ctx)
+}
+
+// The HTTP exporter only says which status it got in the error message.
+var httpStatusError = regexp.MustCompile(`: (\d{3}) [^:]*$`)
+
+// exportErrorType is the error.type of a failed export: the HTTP status or
+// gRPC code that the collector answered with, e.g. "401" or
+// "Unauthenticated", or else "timeout" or "network" if it didn't.
+func exportErrorType(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		if s.Code() == codes.DeadlineExceeded {
+			return "timeout"
+		}
+		return s.Code().String()
+	}
+	if m := httpStatusError.FindStringSubmatch(err.Error()); m != nil {
+		return m[1]
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return "network"
+	}
+	return semconv.ErrorTypeOther.Value.AsString()
+}
@@ -0,0 +1,108 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sumBy adds up the data points of sum by the value of key.
+func sumBy(sum metricdata.Sum[int64], key attribute.Key) map[string]int64 {
+	result := map[string]int64{}
+	for _, dp := range sum.DataPoints {
+		value, _ := dp.Attributes.Value(key)
+		result[value.AsString()] += dp.Value
+	}
+	return result
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	chk := assert.New(t)
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+	pm, err := newPipelineMetrics(mp, 2)
+	require.NoError(t, err)
+
+	// The recorder stands in for a batch span processor that's stuck
+	queue := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(batchQueueGate{pm, queue}),
+		sdktrace.WithSpanProcessor(spanCounter{pm}))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	for i := 0; i < 3; i++ {
+		_, span := tp.Tracer(ScopeName).Start(context.Background(), "span")
+		span.End()
+	}
+	chk.Len(queue.Ended(), 2)
+
+	metrics := collect(t, reader)
+	chk.Equal(int64(3), metrics["kongotel.spans.started"].(metricdata.Sum[int64]).DataPoints[0].Value)
+	chk.Equal(int64(3), metrics["kongotel.spans.ended"].(metricdata.Sum[int64]).DataPoints[0].Value)
+	chk.Equal(int64(2), metrics["kongotel.batch_queue.size"].(metricdata.Gauge[int64]).DataPoints[0].Value)
+	chk.Equal(map[string]int64{dropQueueFull: 1},
+		sumBy(metrics["kongotel.spans.dropped"].(metricdata.Sum[int64]), dropReasonKey))
+
+	unauthorized := &downExporter{InMemoryExporter: tracetest.NewInMemoryExporter()}
+	unauthorized.down.Store(true)
+	exporter := batchQueueExit{pm, measuredExporter{pm, unauthorized, false}}
+	chk.Error(exporter.ExportSpans(context.Background(), queue.Ended()))
+	unauthorized.down.Store(false)
+	_, span := tp.Tracer(ScopeName).Start(context.Background(), "span")
+	span.End()
+	chk.NoError(exporter.ExportSpans(context.Background(), queue.Ended()[2:]))
+
+	metrics = collect(t, reader)
+	chk.Equal(int64(0), metrics["kongotel.batch_queue.size"].(metricdata.Gauge[int64]).DataPoints[0].Value)
+	chk.Equal(map[string]int64{"": 1, "_OTHER": 2},
+		sumBy(metrics["kongotel.spans.exported"].(metricdata.Sum[int64]), semconv.ErrorTypeKey))
+	chk.Equal(map[string]int64{dropQueueFull: 1, dropExportFailed: 2},
+		sumBy(metrics["kongotel.spans.dropped"].(metricdata.Sum[int64]), dropReasonKey))
+	chk.Len(metrics["kongotel.export.duration"].(metricdata.Histogram[float64]).DataPoints, 2)
+}
+
+func TestPipelineMetrics_Retried(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+	pm, err := newPipelineMetrics(mp, 2)
+	require.NoError(t, err)
+
+	down := &downExporter{InMemoryExporter: tracetest.NewInMemoryExporter()}
+	down.down.Store(true)
+	exporter := measuredExporter{pm, down, true}
+	assert.Error(t, exporter.ExportSpans(context.Background(), testSpans(t, "span")))
+
+	_, ok := collect(t, reader)["kongotel.spans.dropped"]
+	assert.False(t, ok, "spans in the export queue aren't dropped")
+}
+
+func TestExportErrorType(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("exporting: %w", context.DeadlineExceeded), "timeout"},
+		{status.Error(codes.Unauthenticated, "bad token"), "Unauthenticated"},
+		{status.Error(codes.DeadlineExceeded, "too slow"), "timeout"},
+		{errors.New("failed to send to http://apm-server:8200/v1/traces: 401 Unauthorized"), "401"},
+		{&url.Error{Op: "Post", URL: "http://apm-server:8200/v1/traces", Err: errors.New("connection refused")}, "network"},
+		{errors.New("retry-able request failure"), "_OTHER"},
+	} {
+		assert.Equal(t, tc.want, exportErrorType(tc.err), tc.err.Error())
+	}
+}
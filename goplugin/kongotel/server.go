@@ -0,0 +1,216 @@
+package kongotel
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/Kong/go-pdk/server"
+)
+
+// StartServer is server.StartServer for a plugin instrumented with
+// NewPlugin. constructor is the plugin's own, unwrapped, constructor.
+// The command line is the caller's to parse, and -dump to answer with Dump;
+// go-pdk parses it again, but by then there's nothing left for it to do.
+//
+// StartServer serves until ctx is done, and then stops Kong connecting for
+// new plugin instances, so the caller can drain the requests in flight.
+// go-pdk can't be stopped, and exits if its listener is closed, so that's
+// done by removing its socket, which leaves the connections Kong already
+// has to the requests on them.
+func StartServer(ctx context.Context, t *Telemetry, constructor func() interface{}, version string, priority int) error {
+	srvErr := make(chan error, 1)
+	go func() {
+		srvErr <- server.StartServer(NewPlugin(ctx, t, constructor), version, priority)
+	}()
+	select {
+	case err := <-srvErr:
+		return err
+	case <-ctx.Done():
+	}
+	socketPath, err := socketPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// socketPath is where go-pdk listens: the executable's name in Kong's
+// prefix.
+func socketPath() (string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	prefix := "/usr/local/kong"
+	if f := flag.Lookup("kong-prefix"); f != nil {
+		prefix = f.Value.String()
+	}
+	return path.Join(prefix, path.Base(execPath)+".socket"), nil
+}
+
+// Dump writes the plugin's info for Kong's query command, as go-pdk's -dump
+// does, for a plugin served by StartServer. go-pdk works out the plugin's
+// schema and phases by reflecting on the type its constructor returns,
+// which for a wrapped plugin would describe the wrapper.
+func Dump(constructor func() interface{}, version string, priority int) error {
+	return dumpInfo(reflect.TypeOf(constructor()), version, priority)
+}
+
+// These mirror what go-pdk dumps.
+type serverInfo struct {
+	Protocol   string
+	SocketPath string
+	Plugins    []pluginInfo
+}
+
+type pluginInfo struct {
+	Name     string
+	Phases   []string
+	Version  string
+	Priority int
+	Schema   schemaDict
+}
+
+type schemaDict map[string]interface{}
+
+func dumpInfo(configType reflect.Type, version string, priority int) error {
+	socketPath, err := socketPath()
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(path.Base(socketPath), ".socket")
+
+	return json.NewEncoder(os.Stdout).Encode(serverInfo{
+		Protocol:   "ProtoBuf:1",
+		SocketPath: socketPath,
+		Plugins: []pluginInfo{{
+			Name:   name,
+			Phases: pluginPhases(configType),
+			Schema: schemaDict{
+				"name": name,
+				"fields": []schemaDict{
+					{"config": pluginSchema(configType)},
+				},
+			},
+			Version:  version,
+			Priority: priority,
+		}},
+	})
+}
+
+// pluginPhases are the phases of the plugin's config, plus those we need
+// to trace its requests. Response is left to the plugin, as having it
+// makes Kong buffer responses.
+func pluginPhases(configType reflect.Type) []string {
+	phases := []string{}
+	for _, name := range []string{"Certificate", "Rewrite", "Access", "Response", "Preread", "Log"} {
+		_, has := configType.MethodByName(name)
+		switch name {
+		case "Rewrite", "Access", "Log":
+			has = true
+		}
+		if has {
+			phases = append(phases, strings.ToLower(name))
+		}
+	}
+	return phases
+}
+
+// pluginSchema is the schema of the plugin's config with our otel record
+// added.
+func pluginSchema(configType reflect.Type) schemaDict {
+	schema := getSchemaDict(configType)
+	if schema == nil || schema["type"] != "record" {
+		return schema
+	}
+	fields := schema["fields"].([]schemaDict)
+	for _, f := range fields {
+		if _, ok := f["otel"]; ok {
+			return schema
+		}
+	}
+	schema["fields"] = append(fields, schemaDict{"otel": getSchemaDict(reflect.TypeOf(Config{}))})
+	return schema
+}
+
+// getSchemaDict is go-pdk's translation of Go types to Kong's schema.
+func getSchemaDict(t reflect.Type) schemaDict {
+	switch t.Kind() {
+	case reflect.String:
+		return schemaDict{"type": "string"}
+
+	case reflect.Bool:
+		return schemaDict{"type": "boolean"}
+
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return schemaDict{"type": "integer"}
+
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return schemaDict{
+			"type":    "integer",
+			"between": []int{0, 2147483648},
+		}
+
+	case reflect.Float32, reflect.Float64:
+		return schemaDict{"type": "number"}
+
+	case reflect.Ptr:
+		return getSchemaDict(t.Elem())
+
+	case reflect.Slice:
+		elemType := getSchemaDict(t.Elem())
+		if elemType == nil {
+			break
+		}
+		return schemaDict{
+			"type":     "array",
+			"elements": elemType,
+		}
+
+	case reflect.Map:
+		kType := getSchemaDict(t.Key())
+		vType := getSchemaDict(t.Elem())
+		if kType == nil || vType == nil {
+			break
+		}
+		return schemaDict{
+			"type":   "map",
+			"keys":   kType,
+			"values": vType,
+		}
+
+	case reflect.Struct:
+		fieldsArray := []schemaDict{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			// ignore unexported fields
+			if len(field.PkgPath) != 0 {
+				continue
+			}
+			typeDecl := getSchemaDict(field.Type)
+			if typeDecl == nil {
+				// ignore unrepresentable types
+				continue
+			}
+			name := field.Tag.Get("json")
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fieldsArray = append(fieldsArray, schemaDict{name: typeDecl})
+		}
+		return schemaDict{
+			"type":   "record",
+			"fields": fieldsArray,
+		}
+	}
+
+	return nil
+}
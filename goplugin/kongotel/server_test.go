@@ -0,0 +1,108 @@
+package kongotel
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginPhases(t *testing.T) {
+	chk := assert.New(t)
+	chk.Equal([]string{"rewrite", "access", "log"},
+		pluginPhases(reflect.TypeOf(&helloPlugin{})))
+	chk.Equal([]string{"rewrite", "access", "response", "log"},
+		pluginPhases(reflect.TypeOf(&phasePlugin{})), "response only if the plugin has it")
+}
+
+func TestPluginSchema(t *testing.T) {
+	chk := assert.New(t)
+
+	schema := pluginSchema(reflect.TypeOf(&helloPlugin{}))
+	chk.Equal("record", schema["type"])
+	names := []string{}
+	for _, f := range schema["fields"].([]schemaDict) {
+		for name := range f {
+			names = append(names, name)
+		}
+	}
+	chk.Equal([]string{"message", "timeout_ms", "otel"}, names)
+
+	otel := schema["fields"].([]schemaDict)[2]["otel"].(schemaDict)
+	chk.Equal("record", otel["type"])
+	chk.Contains(otel["fields"], schemaDict{"sampler_ratio": schemaDict{"type": "number"}})
+	chk.Contains(otel["fields"], schemaDict{"exporter_otlp_headers": schemaDict{
+		"type":   "map",
+		"keys":   schemaDict{"type": "string"},
+		"values": schemaDict{"type": "string"},
+	}})
+}
+
+// TestPluginSchema_AllOTelFields checks that Kong is told about every
+// field of the otel record, or it'd reject configs that set them.
+func TestPluginSchema_AllOTelFields(t *testing.T) {
+	schema := pluginSchema(reflect.TypeOf(&helloPlugin{}))
+	otel := schema["fields"].([]schemaDict)[2]["otel"].(schemaDict)
+	assertSchemaFields(t, "otel", reflect.TypeOf(Config{}), otel)
+}
+
+func assertSchemaFields(t *testing.T, path string, typ reflect.Type, schema schemaDict) {
+	fields := map[string]schemaDict{}
+	for _, f := range schema["fields"].([]schemaDict) {
+		for name, field := range f {
+			fields[name] = field.(schemaDict)
+		}
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := f.Tag.Get("json")
+		field, ok := fields[name]
+		if !assert.True(t, ok, "%s.%s is missing from the schema", path, name) {
+			continue
+		}
+		elem := f.Type
+		for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Slice {
+			elem = elem.Elem()
+			if field["type"] == "array" {
+				field = field["elements"].(schemaDict)
+			}
+		}
+		if elem.Kind() == reflect.Struct {
+			assertSchemaFields(t, path+"."+name, elem, field)
+		}
+	}
+}
+
+func TestStartServer_StopsListening(t *testing.T) {
+	prefix := flag.Lookup("kong-prefix")
+	old := prefix.Value.String()
+	require.NoError(t, prefix.Value.Set(t.TempDir()))
+	t.Cleanup(func() { _ = prefix.Value.Set(old) })
+	socketPath, err := socketPath()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srvErr := make(chan error, 1)
+	go func() {
+		srvErr <- StartServer(ctx, nil, func() interface{} { return &helloPlugin{} }, "1.0", 0)
+	}()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-srvErr)
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "Kong can't connect for new instances")
+}
@@ -0,0 +1,717 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/autoprop"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// Config is the OpenTelemetry section of the plugin's configuration.
+type Config struct {
+	// SDKDisabled leaves requests to the no-op providers, as
+	// OTEL_SDK_DISABLED=true does
+	SDKDisabled bool `json:"sdk_disabled"`
+
+	ExporterOTLPEndpoint string            `json:"exporter_otlp_endpoint"`
+	ExporterOTLPHeaders  map[string]string `json:"exporter_otlp_headers"`
+	// ExporterOTLPProtocol is "http/protobuf", "http/json" or "grpc"
+	ExporterOTLPProtocol string `json:"exporter_otlp_protocol"`
+	// ExporterOTLPCompression is "gzip" or "none"
+	ExporterOTLPCompression string `json:"exporter_otlp_compression"`
+	// Paths to PEM files, for collectors with a private CA or mTLS
+	ExporterOTLPCertificate       string `json:"exporter_otlp_certificate"`
+	ExporterOTLPClientCertificate string `json:"exporter_otlp_client_certificate"`
+	ExporterOTLPClientKey         string `json:"exporter_otlp_client_key"`
+
+	Environment string `json:"deployment_environment"`
+
+	// Sampler is one of the OTEL_TRACES_SAMPLER names, or "rules" to pick
+	// the ratio with SamplingRules.
+	Sampler string `json:"sampler"`
+	// SamplerRatio is the fraction of traces to sample for the ratio
+	// samplers, and for requests that no sampling rule matches.
+	SamplerRatio  *float64       `json:"sampler_ratio"`
+	SamplingRules []samplingRule `json:"sampling_rules"`
+	// TailSampling holds back traces until they're complete, to keep e.g.
+	// the slow and failed ones
+	TailSampling tailSamplingConfig `json:"tail_sampling"`
+
+	BatchTimeoutMs         int `json:"batch_timeout_ms"`
+	BatchMaxQueueSize      int `json:"batch_max_queue_size"`
+	BatchMaxExportSize     int `json:"batch_max_export_size"`
+	MetricExportIntervalMs int `json:"metric_export_interval_ms"`
+	// ExportQueueDir is a directory to queue span batches in until the
+	// collector takes them, so they outlive it being down, and restarts
+	ExportQueueDir      string `json:"export_queue_dir"`
+	ExportQueueMaxBytes int64  `json:"export_queue_max_bytes"`
+
+	// Propagation is "inject", "preserve" or "ignore", like the header_type
+	// of Kong's opentelemetry plugin
+	Propagation string `json:"propagation"`
+	// Trust is whose trace context to continue, by default everyone's
+	Trust trustPolicy `json:"trust"`
+	// The trace context formats to read from clients and write upstream,
+	// named as in OTEL_PROPAGATORS, e.g. "tracecontext", "b3" or "xray"
+	PropagatorsExtract []string `json:"propagators_extract"`
+	PropagatorsInject  []string `json:"propagators_inject"`
+	// BaggageAttributes are baggage keys to copy onto the server span and
+	// the request metrics
+	BaggageAttributes []string `json:"baggage_attributes"`
+	// ConsumerBaggage maps baggage keys to fields of the authenticated
+	// consumer, e.g. "consumer.id", to pass on to the upstream
+	ConsumerBaggage map[string]string `json:"consumer_baggage"`
+	// TraceResponseHeader names a response header to tell clients their
+	// trace id in, e.g. "X-Trace-Id" or "traceresponse"
+	TraceResponseHeader string `json:"trace_response_header"`
+
+	// TracePDKCalls gives each PDK call made in the phase methods a span
+	TracePDKCalls bool `json:"trace_pdk_calls"`
+
+	// The headers and query parameters to record on the server span, or
+	// "*" for all of them but those in CaptureExclude.
+	CaptureRequestHeaders  []string `json:"capture_request_headers"`
+	CaptureResponseHeaders []string `json:"capture_response_headers"`
+	CaptureQueryParams     []string `json:"capture_query_params"`
+	CaptureExclude         []string `json:"capture_exclude"`
+	// Redact are captured with their values replaced, on top of the
+	// credentials that always are.
+	Redact []string `json:"redact"`
+}
+
+// withDefaults fills in anything left unset in the plugin configuration
+// with values suitable for the docker compose setup.
+func (c Config) withDefaults() Config {
+	if !c.SDKDisabled {
+		c.SDKDisabled = os.Getenv("OTEL_SDK_DISABLED") == "true"
+	}
+	if c.ExporterOTLPEndpoint == "" {
+		c.ExporterOTLPEndpoint = "http://apm-server:8200"
+	}
+	if _, ok := c.ExporterOTLPHeaders["Authorization"]; !ok {
+		// The APM secret can't go in kong.yml, so it comes in via the
+		// plugin server's start command.
+		if auth := os.Getenv("ELASTIC_APM_AUTH_HEADER"); auth != "" {
+			headers := map[string]string{"Authorization": auth}
+			for k, v := range c.ExporterOTLPHeaders {
+				headers[k] = v
+			}
+			c.ExporterOTLPHeaders = headers
+		}
+	}
+	if c.ExporterOTLPProtocol == "" {
+		c.ExporterOTLPProtocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if c.ExporterOTLPProtocol == "" {
+		c.ExporterOTLPProtocol = protocolHTTPProtobuf
+	}
+	if c.Environment == "" {
+		c.Environment = "production"
+	}
+	if c.Sampler == "" {
+		if c.SamplerRatio != nil {
+			c.Sampler = samplerParentBasedTraceIDRatio
+		} else {
+			c.Sampler = samplerParentBasedAlwaysOn
+		}
+	}
+	if len(c.PropagatorsExtract) == 0 {
+		c.PropagatorsExtract = defaultPropagators
+	}
+	if len(c.PropagatorsInject) == 0 {
+		c.PropagatorsInject = defaultPropagators
+	}
+	if c.BatchTimeoutMs == 0 {
+		c.BatchTimeoutMs = 5000
+	}
+	if c.MetricExportIntervalMs == 0 {
+		c.MetricExportIntervalMs = 60000
+	}
+	return c
+}
+
+func (c Config) validate() error {
+	if c.SamplerRatio != nil && (*c.SamplerRatio < 0 || *c.SamplerRatio > 1) {
+		return fmt.Errorf("sampler_ratio must be between 0 and 1, got %v", *c.SamplerRatio)
+	}
+	if c.BatchTimeoutMs < 0 || c.BatchMaxQueueSize < 0 || c.BatchMaxExportSize < 0 || c.MetricExportIntervalMs < 0 {
+		return errors.New("batch and export interval settings must not be negative")
+	}
+	if c.ExportQueueMaxBytes < 0 {
+		return errors.New("export_queue_max_bytes must not be negative")
+	}
+	if err := validatePropagation(c.Propagation); err != nil {
+		return err
+	}
+	if _, err := newPropagator(c); err != nil {
+		return err
+	}
+	if err := validateConsumerBaggage(c.ConsumerBaggage); err != nil {
+		return err
+	}
+	if err := c.TailSampling.validate(); err != nil {
+		return err
+	}
+	return validateExporter(c)
+}
+
+// Telemetry owns the process wide OpenTelemetry SDK.
+// Kong only tells us our configuration when it starts a plugin instance,
+// so the SDK is set up by the first instance to handle a request, and
+// rebuilt whenever a newer instance turns up with a different config.
+type Telemetry struct {
+	ctx        context.Context
+	service    service
+	mu         sync.Mutex
+	generation uint64
+	config     Config
+	// built is the generation that config came from, whose pipeline
+	// becomes current once it's built, unless a newer one is built first
+	built   uint64
+	current *pipeline
+	// disabled is whether config turned the SDK off
+	disabled bool
+	// retired pipelines are still finishing in-flight requests
+	retired map[*pipeline]struct{}
+	errors  *errorLog
+
+	// closing stops the SDK being rebuilt once shutdown has begun
+	closing bool
+	// phases counts the phase methods running
+	phases int
+	// idle is closed once closing, with no phases or requests in flight
+	idle chan struct{}
+}
+
+// service identifies the plugin in the telemetry it exports.
+type service struct {
+	name, version string
+}
+
+// NewTelemetry returns a Telemetry for the plugin with the given name and
+// version, which are used as its service.name and service.version.
+// The SDK isn't set up until a plugin instance is configured.
+// The SDK's errors go to Kong's error log.
+func NewTelemetry(ctx context.Context, name, version string) *Telemetry {
+	t := &Telemetry{
+		ctx:     ctx,
+		service: service{name, version},
+		retired: map[*pipeline]struct{}{},
+		errors:  newErrorLog(),
+		idle:    make(chan struct{}),
+	}
+	otel.SetErrorHandler(t.errors)
+	return t
+}
+
+// configure sets up the SDK from conf, if conf comes from a newer plugin
+// instance than the SDK was last configured from and it differs.
+// nodeID is only called when the SDK is (re)built.
+// The SDK is built without holding t.mu, so requests carry on with the
+// current one in the meantime.
+// A nil telemetry leaves the global no-op providers in place.
+func (t *Telemetry) configure(conf Config, generation uint64, nodeID func() (string, error)) error {
+	if t == nil {
+		return nil
+	}
+	conf = conf.withDefaults()
+
+	t.mu.Lock()
+	if t.closing {
+		// Kong may still start instances on the connections it already
+		// has while we're shutting down
+		t.mu.Unlock()
+		return nil
+	}
+	if generation <= t.generation {
+		// Kong may run older instances for a while after starting new ones.
+		t.mu.Unlock()
+		return nil
+	}
+	// Only try each config once, rather than for every request with a
+	// broken one.
+	first := t.generation == 0
+	t.generation = generation
+	if !first && reflect.DeepEqual(conf, t.config) {
+		t.mu.Unlock()
+		return nil
+	}
+	t.config = conf
+	t.built = generation
+	if conf.SDKDisabled {
+		if old := t.current; old != nil {
+			t.retire(old)
+		}
+		t.current = nil
+		t.disabled = true
+		t.mu.Unlock()
+		return nil
+	}
+	t.mu.Unlock()
+
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	id, err := nodeID()
+	if err != nil {
+		// Not worth going without telemetry over
+		otel.Handle(fmt.Errorf("getting kong node id: %w", err))
+	}
+	p, err := setupOTelSDK(t.ctx, conf, t.service, id)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing || t.built != generation {
+		// A newer config was pushed while this one was being built
+		go t.shutdownRetired(p)
+		return nil
+	}
+	p.install()
+
+	if old := t.current; old != nil {
+		t.retire(old)
+	}
+	t.current = p
+	t.disabled = false
+	return nil
+}
+
+// acquire returns the tracer provider, metrics and logger provider for a
+// new request, and a release func to call once the request's spans have
+// all ended.
+// Once shutdown has begun, new requests aren't traced, so that Drain only
+// waits for those already in flight.
+func (t *Telemetry) acquire() (oteltrace.TracerProvider, *serverMetrics, otellog.LoggerProvider, func()) {
+	if t == nil {
+		return otel.GetTracerProvider(), globalServerMetrics(), global.GetLoggerProvider(), func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing || t.disabled {
+		return tracenoop.NewTracerProvider(), noopServerMetrics(), lognoop.NewLoggerProvider(), func() {}
+	}
+	p := t.current
+	if p == nil {
+		return otel.GetTracerProvider(), globalServerMetrics(), global.GetLoggerProvider(), func() {}
+	}
+	p.refs++
+
+	var once sync.Once
+	return p.tracerProvider, p.metrics, p.loggerProvider, func() {
+		once.Do(func() { t.release(p) })
+	}
+}
+
+func (t *Telemetry) release(p *pipeline) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.refs--
+	if _, ok := t.retired[p]; ok && p.refs == 0 {
+		delete(t.retired, p)
+		go t.shutdownRetired(p)
+	}
+	t.checkIdle()
+}
+
+// startPhase counts a phase method as running until the returned func is
+// called, so that shutdown can wait for it.
+func (t *Telemetry) startPhase() func() {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.phases++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.phases--
+		t.checkIdle()
+		t.mu.Unlock()
+	}
+}
+
+// inFlight counts the requests with spans still to end.
+// t.mu must be held.
+func (t *Telemetry) inFlight() int {
+	n := 0
+	if t.current != nil {
+		n += t.current.refs
+	}
+	for p := range t.retired {
+		n += p.refs
+	}
+	return n
+}
+
+// checkIdle closes idle if shutdown is waiting for nothing.
+// t.mu must be held.
+func (t *Telemetry) checkIdle() {
+	select {
+	case <-t.idle:
+		return
+	default:
+	}
+	if t.closing && t.phases == 0 && t.inFlight() == 0 {
+		close(t.idle)
+	}
+}
+
+// retire arranges for p to be shut down once its in-flight requests have
+// finished, or they have been abandoned.
+// t.mu must be held.
+func (t *Telemetry) retire(p *pipeline) {
+	if p.refs == 0 {
+		go t.shutdownRetired(p)
+		return
+	}
+	t.retired[p] = struct{}{}
+	time.AfterFunc(requestTimeout, func() {
+		t.mu.Lock()
+		_, ok := t.retired[p]
+		delete(t.retired, p)
+		t.mu.Unlock()
+		if ok {
+			t.shutdownRetired(p)
+		}
+	})
+}
+
+func (t *Telemetry) shutdownRetired(p *pipeline) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := p.shutdown(ctx); err != nil {
+		log.Printf("shutting down previous telemetry pipeline: %s", err)
+	}
+}
+
+// Drain begins shutting down: newer plugin instances no longer rebuild
+// the SDK, new requests aren't traced, and Drain waits for the phases and
+// requests in flight to finish, so their spans end, until ctx is done.
+func (t *Telemetry) Drain(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	t.closing = true
+	t.checkIdle()
+	t.mu.Unlock()
+	select {
+	case <-t.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown flushes and stops the SDK, if it was set up, along with any
+// pipelines it replaced, and logs the telemetry that was lost: the spans
+// of requests still in flight, and spans that couldn't be exported in
+// time. Call Drain first to give the requests a chance to finish.
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	t.closing = true
+	abandoned := t.inFlight()
+	pipelines := make([]*pipeline, 0, len(t.retired)+1)
+	for p := range t.retired {
+		pipelines = append(pipelines, p)
+		delete(t.retired, p)
+	}
+	if t.current != nil {
+		pipelines = append(pipelines, t.current)
+		t.current = nil
+	}
+	t.mu.Unlock()
+
+	var err error
+	var lost int64
+	for _, p := range pipelines {
+		before := p.spans.lost()
+		err = errors.Join(err, p.shutdown(ctx))
+		lost += p.spans.lost() - before
+	}
+	if abandoned > 0 || lost > 0 {
+		log.Printf("telemetry shut down with %d requests in flight, and %d spans unexported", abandoned, lost)
+	}
+	// With no more requests to log them, Kong logs what we print instead
+	t.errors.flush(func(msg string) { log.Print(msg) })
+	return err
+}
+
+// pipeline is one configuration's worth of the SDK.
+type pipeline struct {
+	propagator     propagation.TextMapPropagator
+	tracerProvider *trace.TracerProvider
+	meterProvider  *metric.MeterProvider
+	loggerProvider *sdklog.LoggerProvider
+	metrics        *serverMetrics
+	spans          *pipelineMetrics
+	shutdown       func(context.Context) error
+
+	// refs counts the requests with spans from tracerProvider.
+	// Guarded by telemetry.mu
+	refs int
+}
+
+// install makes p the global SDK.
+func (p *pipeline) install() {
+	otel.SetTextMapPropagator(p.propagator)
+	otel.SetTracerProvider(p.tracerProvider)
+	otel.SetMeterProvider(p.meterProvider)
+	global.SetLoggerProvider(p.loggerProvider)
+}
+
+// setupOTelSDK bootstraps the OpenTelemetry pipeline.
+// If it does not return an error, make sure to call shutdown for proper cleanup.
+func setupOTelSDK(ctx context.Context, conf Config, svc service, nodeID string) (p *pipeline, err error) {
+	var shutdownFuncs []func(context.Context) error
+
+	// shutdown calls cleanup functions registered via shutdownFuncs.
+	// The errors from the calls are joined.
+	// Each registered cleanup will be invoked once.
+	shutdown := func(ctx context.Context) error {
+		var err error
+		for _, fn := range shutdownFuncs {
+			err = errors.Join(err, fn(ctx))
+		}
+		shutdownFuncs = nil
+		return err
+	}
+
+	// handleErr calls shutdown for cleanup and makes sure that all errors are returned.
+	handleErr := func(inErr error) {
+		err = errors.Join(inErr, shutdown(ctx))
+	}
+
+	p = &pipeline{shutdown: shutdown}
+
+	// Set up propagator.
+	p.propagator, err = newPropagator(conf)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+
+	// Set up resource.
+	res, err := newResource(ctx, conf, svc, nodeID)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+
+	// Read the exporters' settings, and certificates, once for all three.
+	exp, err := newExporterSettings(conf)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+
+	// Set up meter provider, first as the trace provider has metrics.
+	p.meterProvider, err = newMeterProvider(ctx, conf, exp, res)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+	shutdownFuncs = append(shutdownFuncs, p.meterProvider.Shutdown)
+
+	p.spans, err = newPipelineMetrics(p.meterProvider, batchQueueSize(conf))
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+
+	// Set up trace provider.
+	p.tracerProvider, err = newTraceProvider(ctx, conf, exp, res, p.meterProvider, p.spans)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+	// Before the meter provider, for its final metrics
+	shutdownFuncs = append([]func(context.Context) error{p.tracerProvider.Shutdown}, shutdownFuncs...)
+
+	// Set up logger provider.
+	p.loggerProvider, err = newLoggerProvider(ctx, conf, exp, res)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+	shutdownFuncs = append(shutdownFuncs, p.loggerProvider.Shutdown)
+
+	p.metrics, err = newServerMetrics(p.meterProvider)
+	if err != nil {
+		handleErr(err)
+		p = nil
+		return
+	}
+
+	return
+}
+
+func newPropagator(conf Config) (propagation.TextMapPropagator, error) {
+	extract, err := autoprop.TextMapPropagator(conf.PropagatorsExtract...)
+	if err != nil {
+		return nil, fmt.Errorf("propagators_extract: %w", err)
+	}
+	inject, err := autoprop.TextMapPropagator(conf.PropagatorsInject...)
+	if err != nil {
+		return nil, fmt.Errorf("propagators_inject: %w", err)
+	}
+	return splitPropagator{extract: extract, inject: inject}, nil
+}
+
+const kongNodeIDKey = attribute.Key("kong.node.id")
+
+// newResource describes this plugin server, for traces, metrics and logs.
+func newResource(ctx context.Context, conf Config, svc service, nodeID string) (*resource.Resource, error) {
+	// Kong hides env vars from plugins, so we have to configure in code
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(svc.name),
+		semconv.ServiceVersion(svc.version),
+		semconv.DeploymentEnvironment(conf.Environment),
+	}
+	if nodeID != "" {
+		attrs = append(attrs, kongNodeIDKey.String(nodeID))
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithContainer(),
+		// Not the command args, in case a secret is passed that way
+		resource.WithProcessPID(),
+		resource.WithProcessExecutableName(),
+		resource.WithProcessExecutablePath(),
+		resource.WithProcessOwner(),
+		resource.WithProcessRuntimeName(),
+		resource.WithProcessRuntimeVersion(),
+		resource.WithProcessRuntimeDescription(),
+		resource.WithAttributes(attrs...),
+	)
+	if errors.Is(err, resource.ErrPartialResource) {
+		// e.g. we're not in a container. Whatever was detected is still useful.
+		otel.Handle(err)
+		err = nil
+	}
+	return res, err
+}
+
+func newTraceProvider(ctx context.Context, conf Config, exp exporterSettings, res *resource.Resource, mp *metric.MeterProvider, pm *pipelineMetrics) (*trace.TracerProvider, error) {
+	otlpExporter, err := newTraceExporter(ctx, exp)
+	if err != nil {
+		return nil, err
+	}
+	traceExporter := trace.SpanExporter(measuredExporter{pm, otlpExporter, conf.ExportQueueDir != ""})
+	if conf.ExportQueueDir != "" {
+		queue, err := newDiskQueue(conf.ExportQueueDir, conf.ExportQueueMaxBytes,
+			traceExporter, measuredExporter{pm, otlpExporter, false})
+		if err == nil {
+			traceExporter = queue
+			err = queue.registerMetrics(mp)
+		}
+		if err != nil {
+			_ = traceExporter.Shutdown(ctx)
+			return nil, err
+		}
+	}
+
+	batchOpts := []trace.BatchSpanProcessorOption{
+		trace.WithBatchTimeout(time.Duration(conf.BatchTimeoutMs) * time.Millisecond),
+		trace.WithMaxQueueSize(int(pm.queueCapacity)),
+	}
+	if conf.BatchMaxExportSize > 0 {
+		batchOpts = append(batchOpts, trace.WithMaxExportBatchSize(conf.BatchMaxExportSize))
+	}
+
+	var next trace.SpanProcessor = batchQueueGate{pm,
+		trace.NewBatchSpanProcessor(batchQueueExit{pm, traceExporter}, batchOpts...)}
+	if conf.TailSampling.enabled() {
+		tail, err := newTailSampler(conf.TailSampling, next)
+		if err == nil {
+			err = tail.registerMetrics(mp)
+		}
+		if err != nil {
+			_ = next.Shutdown(ctx)
+			return nil, err
+		}
+		next = tail
+	}
+	opts, err := samplingOptions(conf, next)
+	if err != nil {
+		_ = next.Shutdown(ctx)
+		return nil, err
+	}
+	opts = append(opts, trace.WithSpanProcessor(spanCounter{pm}), trace.WithResource(res))
+
+	traceProvider := trace.NewTracerProvider(opts...)
+	return traceProvider, nil
+}
+
+func newMeterProvider(ctx context.Context, conf Config, exp exporterSettings, res *resource.Resource) (*metric.MeterProvider, error) {
+	metricExporter, err := newMetricExporter(ctx, exp)
+	if err != nil {
+		return nil, err
+	}
+
+	meterProvider := metric.NewMeterProvider(
+		metric.WithResource(res),
+		metric.WithReader(metric.NewPeriodicReader(metricExporter,
+			metric.WithInterval(time.Duration(conf.MetricExportIntervalMs)*time.Millisecond))),
+	)
+	return meterProvider, nil
+}
+
+func newLoggerProvider(ctx context.Context, conf Config, exp exporterSettings, res *resource.Resource) (*sdklog.LoggerProvider, error) {
+	logExporter, err := newLogExporter(ctx, exp)
+	if err != nil {
+		return nil, err
+	}
+
+	batchOpts := []sdklog.BatchProcessorOption{
+		sdklog.WithExportInterval(time.Duration(conf.BatchTimeoutMs) * time.Millisecond),
+	}
+	if conf.BatchMaxQueueSize > 0 {
+		batchOpts = append(batchOpts, sdklog.WithMaxQueueSize(conf.BatchMaxQueueSize))
+	}
+	if conf.BatchMaxExportSize > 0 {
+		batchOpts = append(batchOpts, sdklog.WithExportMaxBatchSize(conf.BatchMaxExportSize))
+	}
+
+	loggerProvider := sdklog.NewLoggerProvider(
+		sdklog.WithResource(res),
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(logExporter, batchOpts...)),
+	)
+	return loggerProvider, nil
+}
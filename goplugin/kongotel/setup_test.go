@@ -0,0 +1,336 @@
+package kongotel
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log/global"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestOTelConfig_FromKong(t *testing.T) {
+	chk := assert.New(t)
+	t.Setenv("ELASTIC_APM_AUTH_HEADER", "Bearer secret")
+
+	// Kong sends every field in the schema, with null for those unset
+	data := []byte(`{
+		"message": "heyyyy",
+		"timeout_ms": null,
+		"otel": {
+			"exporter_otlp_endpoint": "http://collector:4318",
+			"exporter_otlp_headers": {"X-Tenant": "staging"},
+			"deployment_environment": "staging",
+			"sampler_ratio": 0.25,
+			"batch_timeout_ms": null,
+			"batch_max_queue_size": 4096,
+			"batch_max_export_size": null,
+			"metric_export_interval_ms": null
+		}
+	}`)
+	p := newTestPlugin()
+	chk.NoError(json.Unmarshal(data, p))
+	chk.Equal("heyyyy", p.config.(*helloPlugin).Message)
+
+	otelConf := p.otel.withDefaults()
+	chk.NoError(otelConf.validate())
+	chk.Equal("http://collector:4318", otelConf.ExporterOTLPEndpoint)
+	chk.Equal(map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Tenant":      "staging",
+	}, otelConf.ExporterOTLPHeaders)
+	chk.Equal("staging", otelConf.Environment)
+	if chk.NotNil(otelConf.SamplerRatio) {
+		chk.Equal(0.25, *otelConf.SamplerRatio)
+	}
+	chk.Equal(5000, otelConf.BatchTimeoutMs)
+	chk.Equal(4096, otelConf.BatchMaxQueueSize)
+	chk.Equal(0, otelConf.BatchMaxExportSize)
+	chk.Equal(60000, otelConf.MetricExportIntervalMs)
+}
+
+func TestOTelConfig_Defaults(t *testing.T) {
+	chk := assert.New(t)
+	t.Setenv("ELASTIC_APM_AUTH_HEADER", "")
+
+	otelConf := Config{}.withDefaults()
+	chk.Equal("http://apm-server:8200", otelConf.ExporterOTLPEndpoint)
+	chk.Empty(otelConf.ExporterOTLPHeaders)
+	chk.Equal("production", otelConf.Environment)
+	chk.Nil(otelConf.SamplerRatio)
+}
+
+func TestOTelConfig_Validate(t *testing.T) {
+	ratio := 1.5
+	chk := assert.New(t)
+	chk.Error(Config{SamplerRatio: &ratio}.validate())
+	chk.Error(Config{BatchTimeoutMs: -1}.validate())
+}
+
+func TestTelemetry_ConfigureOnce(t *testing.T) {
+	chk := assert.New(t)
+
+	var nilTelemetry *Telemetry
+	chk.NoError(nilTelemetry.configure(Config{}, 1, testNodeID))
+	chk.NoError(nilTelemetry.Shutdown(context.Background()))
+
+	ratio := -1.0
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	chk.Error(tel.configure(Config{SamplerRatio: &ratio}, 1, testNodeID))
+	// The failure is only reported the first time around
+	chk.NoError(tel.configure(Config{SamplerRatio: &ratio}, 2, testNodeID))
+	chk.NoError(tel.Shutdown(context.Background()))
+}
+
+func TestTelemetry_Reconfigure(t *testing.T) {
+	chk := assert.New(t)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		global.SetLoggerProvider(lognoop.NewLoggerProvider())
+	})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(collector.Close)
+
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	t.Cleanup(func() { _ = tel.Shutdown(context.Background()) })
+
+	staging := Config{ExporterOTLPEndpoint: collector.URL, Environment: "staging"}
+	chk.NoError(tel.configure(staging, 1, testNodeID))
+	first := tel.current
+	chk.NotNil(first)
+	chk.Same(first.tracerProvider, otel.GetTracerProvider())
+	chk.Same(first.loggerProvider, global.GetLoggerProvider())
+
+	// Same config from a newer instance
+	chk.NoError(tel.configure(staging, 2, testNodeID))
+	chk.Same(first, tel.current)
+
+	// A request in flight on the first pipeline
+	tp, _, _, release := tel.acquire()
+	_, span := tp.Tracer("test").Start(context.Background(), "in flight")
+
+	prod := Config{ExporterOTLPEndpoint: collector.URL, Environment: "production"}
+	chk.NoError(tel.configure(prod, 3, testNodeID))
+	second := tel.current
+	chk.NotSame(first, second)
+	chk.Same(second.tracerProvider, otel.GetTracerProvider())
+	chk.Contains(tel.retired, first, "kept for the request in flight")
+	chk.True(span.IsRecording())
+
+	// An older instance doesn't get to switch it back
+	chk.NoError(tel.configure(staging, 2, testNodeID))
+	chk.Same(second, tel.current)
+
+	span.End()
+	release()
+	release()
+	chk.Empty(tel.retired)
+	chk.Equal(0, first.refs)
+}
+
+func TestTelemetry_Disabled(t *testing.T) {
+	chk := assert.New(t)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		global.SetLoggerProvider(lognoop.NewLoggerProvider())
+	})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(collector.Close)
+
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	t.Cleanup(func() { _ = tel.Shutdown(context.Background()) })
+
+	chk.NoError(tel.configure(Config{ExporterOTLPEndpoint: collector.URL}, 1, testNodeID))
+	chk.NotNil(tel.current)
+
+	chk.NoError(tel.configure(Config{ExporterOTLPEndpoint: collector.URL, SDKDisabled: true}, 2, testNodeID))
+	chk.Nil(tel.current)
+	tp, _, _, release := tel.acquire()
+	_, span := tp.Tracer("test").Start(context.Background(), "untraced")
+	chk.False(span.IsRecording())
+	span.End()
+	release()
+
+	// Turned back on
+	chk.NoError(tel.configure(Config{ExporterOTLPEndpoint: collector.URL}, 3, testNodeID))
+	chk.NotNil(tel.current)
+	tp, _, _, release = tel.acquire()
+	_, span = tp.Tracer("test").Start(context.Background(), "traced")
+	chk.True(span.IsRecording())
+	span.End()
+	release()
+
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	chk.True(Config{}.withDefaults().SDKDisabled)
+}
+
+func TestTelemetry_ConfigureConcurrently(t *testing.T) {
+	chk := assert.New(t)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		global.SetLoggerProvider(lognoop.NewLoggerProvider())
+	})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(collector.Close)
+
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	t.Cleanup(func() { _ = tel.Shutdown(context.Background()) })
+	chk.NoError(tel.configure(Config{ExporterOTLPEndpoint: collector.URL}, 1, testNodeID))
+	first := tel.current
+
+	// A slow rebuild
+	building, unblock := make(chan struct{}), make(chan struct{})
+	slowNodeID := func() (string, error) {
+		close(building)
+		<-unblock
+		return testNodeID()
+	}
+	staging := Config{ExporterOTLPEndpoint: collector.URL, Environment: "staging"}
+	configured := make(chan error, 1)
+	go func() { configured <- tel.configure(staging, 2, slowNodeID) }()
+	<-building
+
+	// Requests carry on with the current pipeline in the meantime
+	acquired := make(chan struct{})
+	go func() {
+		_, _, _, release := tel.acquire()
+		release()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("acquire waited for the rebuild")
+	}
+	chk.Same(first, tel.current)
+
+	// A newer config built in the meantime wins
+	prod := Config{ExporterOTLPEndpoint: collector.URL, Environment: "production"}
+	chk.NoError(tel.configure(prod, 3, testNodeID))
+	newest := tel.current
+	chk.NotSame(first, newest)
+	close(unblock)
+	chk.NoError(<-configured)
+	chk.Same(newest, tel.current)
+	chk.Same(newest.tracerProvider, otel.GetTracerProvider())
+}
+
+func TestTelemetry_Drain(t *testing.T) {
+	chk := assert.New(t)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		global.SetLoggerProvider(lognoop.NewLoggerProvider())
+	})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(collector.Close)
+
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	conf := Config{ExporterOTLPEndpoint: collector.URL}
+	chk.NoError(tel.configure(conf, 1, testNodeID))
+	first := tel.current
+
+	endPhase := tel.startPhase()
+	_, _, _, release := tel.acquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	chk.ErrorIs(tel.Drain(ctx), context.DeadlineExceeded)
+
+	// Instances started during shutdown don't rebuild the SDK
+	chk.NoError(tel.configure(Config{ExporterOTLPEndpoint: collector.URL, Environment: "staging"}, 2, testNodeID))
+	chk.Same(first, tel.current)
+
+	drained := make(chan error, 1)
+	go func() { drained <- tel.Drain(context.Background()) }()
+	endPhase()
+	release()
+	select {
+	case err := <-drained:
+		chk.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("still draining")
+	}
+	chk.NoError(tel.Shutdown(context.Background()))
+	chk.Nil(tel.current)
+}
+
+func TestTelemetry_DrainNewRequests(t *testing.T) {
+	chk := assert.New(t)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		global.SetLoggerProvider(lognoop.NewLoggerProvider())
+	})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(collector.Close)
+
+	tel := NewTelemetry(context.Background(), testService.name, testService.version)
+	t.Cleanup(func() { _ = tel.Shutdown(context.Background()) })
+	chk.NoError(tel.configure(Config{ExporterOTLPEndpoint: collector.URL}, 1, testNodeID))
+
+	_, _, _, release := tel.acquire()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- tel.Drain(ctx) }()
+
+	// Kong keeps sending requests until it stops, which mustn't hold it up
+	chk.Eventually(func() bool {
+		tel.mu.Lock()
+		defer tel.mu.Unlock()
+		return tel.closing
+	}, time.Second, time.Millisecond)
+	tp, _, _, _ := tel.acquire()
+	_, span := tp.Tracer("test").Start(context.Background(), "too late")
+	chk.False(span.IsRecording())
+
+	release()
+	chk.NoError(<-drained)
+}
+
+var testService = service{"goplugin", "0.1.0"}
+
+func testNodeID() (string, error) {
+	return "a9777ac2-57e6-482b-a3c4-ef3d6ca41a1f", nil
+}
+
+func TestNewResource(t *testing.T) {
+	chk := assert.New(t)
+
+	res, err := newResource(context.Background(), Config{Environment: "staging"}, testService, "node-1")
+	chk.NoError(err)
+
+	attrs := res.Set()
+	for k, want := range map[attribute.Key]string{
+		semconv.ServiceNameKey:           testService.name,
+		semconv.ServiceVersionKey:        testService.version,
+		semconv.DeploymentEnvironmentKey: "staging",
+		kongNodeIDKey:                    "node-1",
+	} {
+		got, ok := attrs.Value(k)
+		if chk.True(ok, "%s is set", k) {
+			chk.Equal(want, got.AsString(), k)
+		}
+	}
+	for _, k := range []attribute.Key{
+		semconv.HostNameKey,
+		semconv.ProcessPIDKey,
+		semconv.ProcessRuntimeNameKey,
+		semconv.TelemetrySDKNameKey,
+	} {
+		chk.True(attrs.HasValue(k), "%s is set", k)
+	}
+	chk.False(attrs.HasValue(semconv.ProcessCommandArgsKey))
+}
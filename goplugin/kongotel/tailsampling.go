@@ -0,0 +1,364 @@
+package kongotel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Defaults for the tail sampling buffer.
+const (
+	defaultDecisionWait = 30 * time.Second
+	defaultMaxTraces    = 1000
+	defaultMaxSpans     = 10000
+	tailSweepInterval   = 1 * time.Second
+)
+
+// tailSamplingConfig configures the tail sampler, which buffers the
+// sampled spans of each local trace until its root ends, and then keeps
+// the trace only if one of the policies matches it.
+type tailSamplingConfig struct {
+	// DecisionWaitMs is how long a trace may wait for a root span that
+	// this plugin server never started
+	DecisionWaitMs int `json:"decision_wait_ms"`
+	// MaxTraces and MaxSpans cap what's buffered
+	MaxTraces int          `json:"max_traces"`
+	MaxSpans  int          `json:"max_spans"`
+	Policies  []tailPolicy `json:"policies"`
+}
+
+func (c tailSamplingConfig) enabled() bool {
+	return len(c.Policies) > 0
+}
+
+func (c tailSamplingConfig) validate() error {
+	if c.DecisionWaitMs < 0 || c.MaxTraces < 0 || c.MaxSpans < 0 {
+		return errors.New("tail_sampling limits must not be negative")
+	}
+	for _, p := range c.Policies {
+		if _, err := compileTailPolicy(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tailPolicy keeps a ratio of the traces that match all of its non-empty
+// conditions. A policy without conditions matches every trace.
+type tailPolicy struct {
+	// MinDurationMs matches traces whose root span took at least this long
+	MinDurationMs int `json:"min_duration_ms"`
+	// Errors matches traces with a span whose status is Error
+	Errors bool `json:"errors"`
+	// Route matches the kong.route.name of the root span
+	Route string `json:"route"`
+	// Attribute matches traces with a span that has the attribute, with
+	// one of Values if there are any
+	Attribute string   `json:"attribute"`
+	Values    []string `json:"values"`
+	// Ratio defaults to keeping every trace the policy matches
+	Ratio *float64 `json:"ratio"`
+}
+
+type compiledTailPolicy struct {
+	tailPolicy
+	sampler trace.Sampler
+}
+
+func compileTailPolicy(p tailPolicy) (compiledTailPolicy, error) {
+	ratio := 1.0
+	if p.Ratio != nil {
+		ratio = *p.Ratio
+	}
+	if ratio < 0 || ratio > 1 {
+		return compiledTailPolicy{}, fmt.Errorf("tail sampling policy %+v: ratio must be between 0 and 1", p)
+	}
+	if p.MinDurationMs < 0 {
+		return compiledTailPolicy{}, fmt.Errorf("tail sampling policy %+v: min_duration_ms must not be negative", p)
+	}
+	return compiledTailPolicy{tailPolicy: p, sampler: trace.TraceIDRatioBased(ratio)}, nil
+}
+
+func (p compiledTailPolicy) matches(root trace.ReadOnlySpan, spans []trace.ReadOnlySpan) bool {
+	if p.MinDurationMs > 0 && root.EndTime().Sub(root.StartTime()) < time.Duration(p.MinDurationMs)*time.Millisecond {
+		return false
+	}
+	if p.Route != "" {
+		route, _, _, _ := requestFields(root.Attributes())
+		if route != p.Route {
+			return false
+		}
+	}
+	if p.Errors && !anySpan(spans, func(s trace.ReadOnlySpan) bool {
+		return s.Status().Code == codes.Error
+	}) {
+		return false
+	}
+	if p.Attribute != "" && !anySpan(spans, p.hasAttribute) {
+		return false
+	}
+	return true
+}
+
+func (p compiledTailPolicy) hasAttribute(s trace.ReadOnlySpan) bool {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) != p.Attribute {
+			continue
+		}
+		if len(p.Values) == 0 {
+			return true
+		}
+		for _, v := range p.Values {
+			if kv.Value.Emit() == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anySpan(spans []trace.ReadOnlySpan, f func(trace.ReadOnlySpan) bool) bool {
+	for _, s := range spans {
+		if f(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tail sampling decisions, for the metrics.
+const (
+	tailDecisionKept    = "kept"
+	tailDecisionDropped = "dropped"
+	// tailDecisionExpired traces gave up waiting for their root span
+	tailDecisionExpired = "expired"
+)
+
+var tailDecisionKey = attribute.Key("kongotel.tail_sampling.decision")
+
+// tailSampler is a SpanProcessor that holds back the sampled spans of each
+// local trace until its root span ends, then hands the whole trace on to
+// next if the policies keep it, however long the request took. Spans that
+// don't fit in the buffer are dropped, and counted as overflowed, as there's
+// no telling yet whether their trace will be kept; the trace is still
+// decided on its root and whichever spans were buffered. Traces whose root
+// was never started here are dropped once they've waited long enough for
+// it, as are those whose root outlives the requests that Kong abandons.
+type tailSampler struct {
+	policies  []compiledTailPolicy
+	wait      time.Duration
+	maxTraces int
+	maxSpans  int
+	next      trace.SpanProcessor
+	now       func() time.Time
+
+	mu     sync.Mutex
+	traces map[oteltrace.TraceID]*bufferedTrace
+	spans  int
+	// open are the root spans started and not yet ended, by when they
+	// started
+	open      map[oteltrace.TraceID]time.Time
+	lastSweep time.Time
+
+	kept, dropped, expired, overflowed atomic.Int64
+}
+
+type bufferedTrace struct {
+	spans     []trace.ReadOnlySpan
+	firstSeen time.Time
+}
+
+func newTailSampler(conf tailSamplingConfig, next trace.SpanProcessor) (*tailSampler, error) {
+	t := &tailSampler{
+		wait:      time.Duration(conf.DecisionWaitMs) * time.Millisecond,
+		maxTraces: conf.MaxTraces,
+		maxSpans:  conf.MaxSpans,
+		next:      next,
+		now:       time.Now,
+		traces:    map[oteltrace.TraceID]*bufferedTrace{},
+		open:      map[oteltrace.TraceID]time.Time{},
+	}
+	if t.wait == 0 {
+		t.wait = defaultDecisionWait
+	}
+	if t.maxTraces == 0 {
+		t.maxTraces = defaultMaxTraces
+	}
+	if t.maxSpans == 0 {
+		t.maxSpans = defaultMaxSpans
+	}
+	for _, p := range conf.Policies {
+		c, err := compileTailPolicy(p)
+		if err != nil {
+			return nil, err
+		}
+		t.policies = append(t.policies, c)
+	}
+	t.lastSweep = t.now()
+	return t, nil
+}
+
+// OnStart notes the roots in progress, whose traces wait for them however
+// long they take.
+func (t *tailSampler) OnStart(_ context.Context, s trace.ReadWriteSpan) {
+	if !s.SpanContext().IsSampled() || !isLocalRoot(s) {
+		return
+	}
+	now := t.now()
+	t.mu.Lock()
+	t.open[s.SpanContext().TraceID()] = now
+	t.mu.Unlock()
+}
+
+func (t *tailSampler) OnEnd(s trace.ReadOnlySpan) {
+	if !s.SpanContext().IsSampled() {
+		return
+	}
+	traceID := s.SpanContext().TraceID()
+	isRoot := isLocalRoot(s)
+	now := t.now()
+
+	t.mu.Lock()
+	t.sweep(now)
+	if isRoot {
+		delete(t.open, traceID)
+	}
+	bt, ok := t.traces[traceID]
+	if !isRoot {
+		switch {
+		case !ok && len(t.traces) >= t.maxTraces, t.spans >= t.maxSpans:
+			t.overflowed.Add(1)
+		case !ok:
+			t.traces[traceID] = &bufferedTrace{spans: []trace.ReadOnlySpan{s}, firstSeen: now}
+			t.spans++
+		default:
+			bt.spans = append(bt.spans, s)
+			t.spans++
+		}
+		t.mu.Unlock()
+		return
+	}
+	var spans []trace.ReadOnlySpan
+	if ok {
+		spans = bt.spans
+		delete(t.traces, traceID)
+		t.spans -= len(spans)
+	}
+	t.mu.Unlock()
+
+	spans = append(spans, s)
+	if !t.decide(s, spans) {
+		t.dropped.Add(1)
+		return
+	}
+	t.kept.Add(1)
+	for _, span := range spans {
+		t.next.OnEnd(span)
+	}
+}
+
+// decide is whether to keep the trace of root. The first policy to match
+// decides.
+func (t *tailSampler) decide(root trace.ReadOnlySpan, spans []trace.ReadOnlySpan) bool {
+	for _, p := range t.policies {
+		if !p.matches(root, spans) {
+			continue
+		}
+		result := p.sampler.ShouldSample(trace.SamplingParameters{
+			ParentContext: context.Background(),
+			TraceID:       root.SpanContext().TraceID(),
+		})
+		return result.Decision == trace.RecordAndSample
+	}
+	return false
+}
+
+func isLocalRoot(s trace.ReadOnlySpan) bool {
+	return !s.Parent().IsValid() || s.Parent().IsRemote()
+}
+
+// sweep drops traces that have waited too long for a root span that isn't
+// in progress. Roots that have been in progress for longer than Kong's
+// requests are given up on, as the request registry does.
+// t.mu must be held.
+func (t *tailSampler) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < tailSweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for id, started := range t.open {
+		if now.Sub(started) > requestTimeout {
+			delete(t.open, id)
+		}
+	}
+	for id, bt := range t.traces {
+		if _, ok := t.open[id]; ok {
+			continue
+		}
+		if now.Sub(bt.firstSeen) > t.wait {
+			delete(t.traces, id)
+			t.spans -= len(bt.spans)
+			t.expired.Add(1)
+		}
+	}
+}
+
+// registerMetrics reports the tail sampler's decisions, and what it's
+// holding, with mp.
+func (t *tailSampler) registerMetrics(mp metric.MeterProvider) error {
+	meter := mp.Meter(ScopeName)
+	traces, err := meter.Int64ObservableCounter("kongotel.tail_sampling.traces",
+		metric.WithDescription("Local traces decided by the tail sampler."),
+		metric.WithUnit("{trace}"))
+	if err != nil {
+		return err
+	}
+	overflowed, err := meter.Int64ObservableCounter("kongotel.tail_sampling.overflowed_spans",
+		metric.WithDescription("Spans that didn't fit in the tail sampling buffer."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return err
+	}
+	buffered, err := meter.Int64ObservableGauge("kongotel.tail_sampling.buffered_spans",
+		metric.WithDescription("Spans held by the tail sampler awaiting a decision."),
+		metric.WithUnit("{span}"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(traces, t.kept.Load(), metric.WithAttributes(tailDecisionKey.String(tailDecisionKept)))
+		o.ObserveInt64(traces, t.dropped.Load(), metric.WithAttributes(tailDecisionKey.String(tailDecisionDropped)))
+		o.ObserveInt64(traces, t.expired.Load(), metric.WithAttributes(tailDecisionKey.String(tailDecisionExpired)))
+		o.ObserveInt64(overflowed, t.overflowed.Load())
+		t.mu.Lock()
+		o.ObserveInt64(buffered, int64(t.spans))
+		t.mu.Unlock()
+		return nil
+	}, traces, overflowed, buffered)
+	return err
+}
+
+// Shutdown drops whatever is still undecided, and shuts down next, which
+// only we hand spans to.
+func (t *tailSampler) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.expired.Add(int64(len(t.traces)))
+	t.traces = map[oteltrace.TraceID]*bufferedTrace{}
+	t.open = map[oteltrace.TraceID]time.Time{}
+	t.spans = 0
+	t.mu.Unlock()
+	return t.next.Shutdown(ctx)
+}
+
+func (t *tailSampler) ForceFlush(ctx context.Context) error {
+	return t.next.ForceFlush(ctx)
+}
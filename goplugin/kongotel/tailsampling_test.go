@@ -0,0 +1,216 @@
+package kongotel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTailSampler(t *testing.T, conf tailSamplingConfig) (*tailSampler, trace.Tracer, *fakeExporter) {
+	exporter := NewFakeExporter()
+	tail, err := newTailSampler(conf, sdktrace.NewSimpleSpanProcessor(exporter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(tail))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	return tail, tp.Tracer("test"), exporter
+}
+
+// localTrace makes a server span with a phase span inside it.
+func localTrace(tracer trace.Tracer, duration time.Duration, rootAttrs []attribute.KeyValue, child func(trace.Span)) {
+	start := time.Now()
+	ctx, root := tracer.Start(context.Background(), "GET route_66",
+		trace.WithTimestamp(start), trace.WithAttributes(rootAttrs...))
+	_, span := tracer.Start(ctx, "Access")
+	if child != nil {
+		child(span)
+	}
+	span.End()
+	root.End(trace.WithTimestamp(start.Add(duration)))
+}
+
+func TestTailSampler_Policies(t *testing.T) {
+	none := 0.0
+	conf := tailSamplingConfig{Policies: []tailPolicy{
+		{Errors: true},
+		{MinDurationMs: 500},
+		{Route: "slow_route", Ratio: &none},
+		{Route: "route_66", Attribute: "tenant.id", Values: []string{"acme"}},
+	}}
+	failed := func(s trace.Span) { s.SetStatus(codes.Error, "boom") }
+	acme := func(s trace.Span) { s.SetAttributes(attribute.String("tenant.id", "acme")) }
+	route := func(name string) []attribute.KeyValue {
+		return []attribute.KeyValue{kongRouteNameKey.String(name)}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		duration time.Duration
+		route    string
+		child    func(trace.Span)
+		kept     bool
+	}{
+		{"fast and fine", 10 * time.Millisecond, "route_66", nil, false},
+		{"failed", 10 * time.Millisecond, "route_66", failed, true},
+		{"slow", time.Second, "route_66", nil, true},
+		{"failed on a dropped route", 10 * time.Millisecond, "slow_route", failed, true},
+		{"attribute on route", 10 * time.Millisecond, "route_66", acme, true},
+		{"attribute on another route", 10 * time.Millisecond, "slow_route", acme, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chk := assert.New(t)
+			tail, tracer, exporter := newTestTailSampler(t, conf)
+
+			localTrace(tracer, tc.duration, route(tc.route), tc.child)
+
+			if tc.kept {
+				if chk.Len(*exporter.spans, 2, "the whole trace") {
+					chk.Equal("Access", (*exporter.spans)[0].Name())
+					chk.Equal("GET route_66", (*exporter.spans)[1].Name())
+				}
+				chk.Equal(int64(1), tail.kept.Load())
+			} else {
+				chk.Empty(*exporter.spans)
+				chk.Equal(int64(1), tail.dropped.Load())
+			}
+			chk.Empty(tail.traces, "nothing left buffered")
+			chk.Zero(tail.spans)
+		})
+	}
+}
+
+func TestTailSampler_Limits(t *testing.T) {
+	chk := assert.New(t)
+	tail, tracer, exporter := newTestTailSampler(t, tailSamplingConfig{
+		MaxTraces: 1,
+		Policies:  []tailPolicy{{}},
+	})
+	now := time.Now()
+	tail.now = func() time.Time { return now }
+
+	// The first trace is still going
+	ctx, first := tracer.Start(context.Background(), "first")
+	_, span := tracer.Start(ctx, "first child")
+	span.End()
+	chk.Len(tail.traces, 1)
+
+	// so there's no room for the second's child
+	localTrace(tracer, time.Millisecond, nil, nil)
+	chk.Equal(int64(1), tail.overflowed.Load())
+	if chk.Len(*exporter.spans, 1, "the child was dropped, and the trace decided on its root") {
+		chk.Equal("GET route_66", (*exporter.spans)[0].Name())
+	}
+
+	// and the first is still going after the decision wait
+	now = now.Add(defaultDecisionWait + time.Second)
+	localTrace(tracer, time.Millisecond, nil, nil)
+	chk.Equal(int64(0), tail.expired.Load())
+	chk.Len(*exporter.spans, 2)
+
+	// but not for longer than Kong's requests get
+	now = now.Add(requestTimeout)
+	localTrace(tracer, time.Millisecond, nil, nil)
+	chk.Equal(int64(1), tail.expired.Load())
+	chk.Len(*exporter.spans, 4)
+
+	first.End()
+	chk.Len(*exporter.spans, 5, "decided on the root alone")
+}
+
+func TestTailSampler_SlowRequest(t *testing.T) {
+	chk := assert.New(t)
+	tail, tracer, exporter := newTestTailSampler(t, tailSamplingConfig{
+		DecisionWaitMs: 10,
+		Policies:       []tailPolicy{{MinDurationMs: 1000}},
+	})
+	now := time.Now()
+	tail.now = func() time.Time { return now }
+
+	start := now
+	ctx, root := tracer.Start(context.Background(), "GET route_66", trace.WithTimestamp(start))
+	_, span := tracer.Start(ctx, "Access")
+	span.End()
+
+	// Another request's spans set off a sweep while it's still going
+	now = now.Add(2 * time.Second)
+	localTrace(tracer, time.Millisecond, nil, nil)
+
+	_, span = tracer.Start(ctx, "Log")
+	span.End()
+	root.End(trace.WithTimestamp(now))
+	chk.Equal(int64(0), tail.expired.Load())
+	var names []string
+	for _, s := range *exporter.spans {
+		if s.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			names = append(names, s.Name())
+		}
+	}
+	chk.Equal([]string{"Access", "Log", "GET route_66"}, names)
+
+	// A trace whose root was never started here only gets the wait
+	other := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sdktrace.NewSimpleSpanProcessor(NewFakeExporter())))
+	t.Cleanup(func() { _ = other.Shutdown(context.Background()) })
+	ctx, orphanRoot := other.Tracer("test").Start(context.Background(), "elsewhere")
+	_, orphan := tracer.Start(ctx, "orphan")
+	orphan.End()
+	chk.Len(tail.traces, 1)
+	now = now.Add(2 * time.Second)
+	localTrace(tracer, time.Millisecond, nil, nil)
+	chk.Equal(int64(1), tail.expired.Load())
+	orphanRoot.End()
+}
+
+func TestTailSampler_Metrics(t *testing.T) {
+	chk := assert.New(t)
+	tail, tracer, _ := newTestTailSampler(t, tailSamplingConfig{
+		Policies: []tailPolicy{{Errors: true}},
+	})
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+	chk.NoError(tail.registerMetrics(mp))
+
+	localTrace(tracer, time.Millisecond, nil, nil)
+	localTrace(tracer, time.Millisecond, nil, func(s trace.Span) { s.SetStatus(codes.Error, "") })
+	localTrace(tracer, time.Millisecond, nil, nil)
+	_, pending := tracer.Start(trace.ContextWithSpan(context.Background(), pendingRoot(tracer)), "pending")
+	pending.End()
+
+	metrics := collect(t, reader)
+	if traces, ok := metrics["kongotel.tail_sampling.traces"].(metricdata.Sum[int64]); chk.True(ok) {
+		byDecision := map[string]int64{}
+		for _, dp := range traces.DataPoints {
+			decision, _ := dp.Attributes.Value(tailDecisionKey)
+			byDecision[decision.AsString()] = dp.Value
+		}
+		chk.Equal(map[string]int64{"kept": 1, "dropped": 2, "expired": 0}, byDecision)
+	}
+	if buffered, ok := metrics["kongotel.tail_sampling.buffered_spans"].(metricdata.Gauge[int64]); chk.True(ok) {
+		chk.Equal(int64(1), buffered.DataPoints[0].Value)
+	}
+}
+
+// pendingRoot is a root span that hasn't ended.
+func pendingRoot(tracer trace.Tracer) trace.Span {
+	_, span := tracer.Start(context.Background(), "pending root")
+	return span
+}
+
+func TestTailSamplingConfig_Validate(t *testing.T) {
+	chk := assert.New(t)
+	tooMuch := 1.5
+	chk.NoError(tailSamplingConfig{}.validate())
+	chk.False(tailSamplingConfig{}.enabled())
+	chk.Error(tailSamplingConfig{MaxSpans: -1}.validate())
+	chk.Error(tailSamplingConfig{Policies: []tailPolicy{{Ratio: &tooMuch}}}.validate())
+	chk.Error(tailSamplingConfig{Policies: []tailPolicy{{MinDurationMs: -1}}}.validate())
+}
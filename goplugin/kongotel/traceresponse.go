@@ -0,0 +1,60 @@
+package kongotel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Kong/go-pdk"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceResponseW3C is the header from the W3C Trace Context Level 2 draft,
+// https://www.w3.org/TR/trace-context-2/#traceresponse-header
+const traceResponseW3C = "traceresponse"
+
+// traceResponseValue is what we tell the client about the trace of sc.
+// traceresponse is formatted like traceparent, with our span as the
+// parent, so it always has the trace flags of the head sampling decision.
+// Any other header gets the trace id to search for, and whether it was
+// sampled, e.g. "4bf92f3577b34da6a3ce929d0e0e4736;sampled=1", unless the
+// spans aren't decided until they end.
+func traceResponseValue(header string, sc trace.SpanContext, deferred bool) string {
+	if strings.EqualFold(header, traceResponseW3C) {
+		return fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags())
+	}
+	if deferred {
+		return sc.TraceID().String()
+	}
+	sampled := 0
+	if sc.IsSampled() {
+		sampled = 1
+	}
+	return fmt.Sprintf("%s;sampled=%d", sc.TraceID(), sampled)
+}
+
+type traceResponseKey struct{}
+
+// setTraceResponse sets the trace response header, if one is configured,
+// on the response to the client, and returns ctx with its value for
+// TraceResponse. A failure is recorded on the span of ctx.
+func (o requestOptions) setTraceResponse(ctx context.Context, kong *pdk.PDK) (context.Context, error) {
+	sc := trace.SpanContextFromContext(ctx)
+	if o.traceResponseHeader == "" || !sc.IsValid() {
+		return ctx, nil
+	}
+	value := traceResponseValue(o.traceResponseHeader, sc, o.samplingDeferred)
+	if err := kong.Response.SetHeader(o.traceResponseHeader, value); err != nil {
+		RecordPDKError(trace.SpanFromContext(ctx), "kong.response.set_header", err)
+		return ctx, err
+	}
+	return context.WithValue(ctx, traceResponseKey{}, value), nil
+}
+
+// TraceResponse returns the value of the trace response header sent to
+// the client, if trace_response_header is configured, for a plugin to
+// pass on in its own responses. ctx is that from Context.
+func TraceResponse(ctx context.Context) (string, bool) {
+	value, ok := ctx.Value(traceResponseKey{}).(string)
+	return value, ok
+}
@@ -0,0 +1,109 @@
+package kongotel
+
+import (
+	"context"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/Kong/go-pdk"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceResponseValue(t *testing.T) {
+	chk := assert.New(t)
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:  trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	})
+
+	chk.Equal("4bf92f3577b34da6a3ce929d0e0e4736;sampled=0", traceResponseValue("X-Trace-Id", sc, false))
+	chk.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", traceResponseValue("traceresponse", sc, false))
+
+	sc = sc.WithTraceFlags(trace.FlagsSampled)
+	chk.Equal("4bf92f3577b34da6a3ce929d0e0e4736;sampled=1", traceResponseValue("X-Trace-Id", sc, false))
+	chk.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceResponseValue("TraceResponse", sc, false))
+
+	// Tail sampling may yet drop it
+	chk.Equal("4bf92f3577b34da6a3ce929d0e0e4736", traceResponseValue("X-Trace-Id", sc, true))
+	chk.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceResponseValue("traceresponse", sc, true))
+}
+
+// traceResponsePlugin keeps the trace responses it sees
+type traceResponsePlugin struct{ seen *[]string }
+
+func (p traceResponsePlugin) Access(kong *pdk.PDK) {
+	if value, ok := TraceResponse(Context(kong)); ok {
+		*p.seen = append(*p.seen, value)
+	}
+}
+
+func TestTraceResponse(t *testing.T) {
+	for _, header := range []string{"", "traceresponse"} {
+		t.Run(header, func(t *testing.T) {
+			chk := assert.New(t)
+
+			exporter := NewFakeExporter()
+			setupOTEL(t, exporter)
+
+			env, err := test.New(t, test.Request{
+				Method: "GET",
+				Url:    "http://example.com/plugin",
+			})
+			chk.NoError(err)
+
+			var seen []string
+			New := NewPlugin(context.Background(), nil, func() interface{} {
+				return &traceResponsePlugin{&seen}
+			})
+			conf := New().(*plugin)
+			chk.NoError(conf.UnmarshalJSON([]byte(`{"otel": {"trace_response_header": "` + header + `"}}`)))
+			env.DoHttp(conf)
+
+			if header == "" {
+				chk.Empty(seen)
+				chk.Empty(env.ClientRes.Headers.Get("traceresponse"))
+				return
+			}
+			if chk.Len(*exporter.spans, 5) {
+				serverSpan := (*exporter.spans)[4].SpanContext()
+				want := "00-" + serverSpan.TraceID().String() + "-" + serverSpan.SpanID().String() + "-01"
+				chk.Equal(want, env.ClientRes.Headers.Get("traceresponse"))
+				chk.Equal([]string{want}, seen)
+			}
+		})
+	}
+}
+
+// rejectingPlugin turns requests away in its rewrite phase, as a global
+// plugin can.
+type rejectingPlugin struct{}
+
+func (*rejectingPlugin) Rewrite(kong *pdk.PDK) { kong.Response.ExitStatus(403) }
+
+func TestTraceResponse_RewriteExit(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+	})
+	chk.NoError(err)
+
+	New := NewPlugin(context.Background(), nil, func() interface{} { return &rejectingPlugin{} })
+	conf := New().(*plugin)
+	chk.NoError(conf.UnmarshalJSON([]byte(`{"otel": {"trace_response_header": "traceresponse"}}`)))
+	env.DoHttp(conf)
+
+	chk.Equal(403, env.ClientRes.Status)
+	if chk.NotEmpty(*exporter.spans) {
+		spans := *exporter.spans
+		serverSpan := spans[len(spans)-1].SpanContext()
+		want := "00-" + serverSpan.TraceID().String() + "-" + serverSpan.SpanID().String() + "-01"
+		chk.Equal(want, env.ClientRes.Headers.Get("traceresponse"), "set before the plugin's rewrite phase")
+	}
+}
@@ -0,0 +1,71 @@
+package kongotel
+
+import (
+	"net/http"
+
+	"github.com/Kong/go-pdk"
+)
+
+// trustPolicy decides whose trace context we continue. Anyone else could
+// pick our trace ids and sampling decisions, so their context only gets a
+// span link from a new trace. A request is trusted if any of the policy's
+// conditions holds, and the empty policy trusts everyone.
+type trustPolicy struct {
+	// TrustedIPs trusts clients connecting from Kong's trusted_ips
+	TrustedIPs bool `json:"trusted_ips"`
+	// Header trusts requests that have it, with HeaderValue if that's set,
+	// e.g. a header that the load balancer in front of Kong adds
+	Header      string `json:"header"`
+	HeaderValue string `json:"header_value"`
+	// Routes are the names of routes whose clients are trusted.
+	// Requests a global plugin sees in the rewrite phase aren't routed yet,
+	// so don't match.
+	Routes []string `json:"routes"`
+}
+
+func (p trustPolicy) isEmpty() bool {
+	return !p.TrustedIPs && p.Header == "" && len(p.Routes) == 0
+}
+
+// trusts is whether to continue the client's trace. The PDK is only
+// asked about the client when the policy needs it, and if it can't say,
+// the client isn't trusted.
+func (p trustPolicy) trusts(kong *pdk.PDK, r *serverRequest) bool {
+	if p.isEmpty() {
+		return true
+	}
+	if p.Header != "" {
+		if values, ok := r.headers[http.CanonicalHeaderKey(p.Header)]; ok {
+			if p.HeaderValue == "" {
+				return true
+			}
+			for _, v := range values {
+				if v == p.HeaderValue {
+					return true
+				}
+			}
+		}
+	}
+	if r.route.known {
+		for _, name := range p.Routes {
+			if name == r.route.name {
+				return true
+			}
+		}
+	}
+	if p.TrustedIPs {
+		// The address of the connection, not whatever X-Forwarded-For says
+		ip, err := kong.Client.GetIp()
+		if err != nil {
+			r.failed = append(r.failed, pdkCallError{"kong.client.get_ip", err})
+			return false
+		}
+		trusted, err := kong.IP.IsTrusted(ip)
+		if err != nil {
+			r.failed = append(r.failed, pdkCallError{"kong.ip.is_trusted", err})
+			return false
+		}
+		return trusted
+	}
+	return false
+}
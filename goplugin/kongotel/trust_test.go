@@ -0,0 +1,118 @@
+package kongotel
+
+import (
+	"context"
+	"testing"
+
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestTrustPolicy(t *testing.T) {
+	const (
+		clientTraceID = "f68de45b0b36ac1c97c2a43166c9cb8f"
+		clientSpanID  = "9a94fd01ca53f63d"
+	)
+
+	for _, tc := range []struct {
+		name    string
+		trust   string
+		headers map[string][]string
+		trusted bool
+	}{
+		{"no policy", `{}`, nil, true},
+		{"trusted ip", `{"trusted_ips": true}`, nil, true},
+		{"untrusted ip", `{"trusted_ips": true}`, nil, false},
+		{"header present", `{"header": "x-internal"}`, map[string][]string{"x-internal": {"yes"}}, true},
+		{"header missing", `{"header": "x-internal"}`, nil, false},
+		{"header value", `{"header": "x-internal", "header_value": "s3cr3t"}`, map[string][]string{"x-internal": {"s3cr3t"}}, true},
+		{"wrong header value", `{"header": "x-internal", "header_value": "s3cr3t"}`, map[string][]string{"x-internal": {"guess"}}, false},
+		{"trusted route", `{"routes": ["route_66"]}`, nil, true},
+		{"untrusted route", `{"routes": ["internal"]}`, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chk := assert.New(t)
+
+			exporter := NewFakeExporter()
+			setupOTEL(t, exporter)
+			otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+				propagation.TraceContext{}, propagation.Baggage{},
+			))
+
+			headers := map[string][]string{
+				"traceparent": {"00-" + clientTraceID + "-" + clientSpanID + "-01"},
+				"baggage":     {"tenant.id=acme"},
+			}
+			for k, v := range tc.headers {
+				headers[k] = v
+			}
+			env, err := test.New(t, test.Request{
+				Method:  "GET",
+				Url:     "http://example.com/plugin",
+				Headers: headers,
+			})
+			chk.NoError(err)
+			if tc.name == "untrusted ip" {
+				env.TrustedIPs = []string{"192.168.0.1"}
+			}
+
+			New := NewPlugin(context.Background(), nil, func() interface{} { return &helloPlugin{} })
+			conf := New().(*plugin)
+			chk.NoError(conf.UnmarshalJSON([]byte(`{"otel": {"trust": ` + tc.trust + `}}`)))
+			env.DoHttp(conf)
+
+			if !chk.Len(*exporter.spans, 5) {
+				return
+			}
+			serverSpan := (*exporter.spans)[4]
+			upstream, err := baggage.Parse(env.ServiceReq.Headers.Get("baggage"))
+			chk.NoError(err)
+			if tc.trusted {
+				chk.Equal(clientTraceID, serverSpan.Parent().TraceID().String())
+				chk.Equal(clientSpanID, serverSpan.Parent().SpanID().String())
+				chk.Empty(serverSpan.Links())
+				chk.Equal("acme", upstream.Member("tenant.id").Value())
+			} else {
+				chk.False(serverSpan.Parent().IsValid(), "a new root")
+				chk.NotEqual(clientTraceID, serverSpan.SpanContext().TraceID().String())
+				if chk.Len(serverSpan.Links(), 1) {
+					link := serverSpan.Links()[0].SpanContext
+					chk.Equal(clientTraceID, link.TraceID().String())
+					chk.Equal(clientSpanID, link.SpanID().String())
+				}
+				chk.Empty(upstream.Member("tenant.id").Value(), "baggage dropped")
+			}
+		})
+	}
+}
+
+func TestTrustPolicy_PDKErrors(t *testing.T) {
+	chk := assert.New(t)
+
+	exporter := NewFakeExporter()
+	setupOTEL(t, exporter)
+
+	env, err := test.New(t, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/plugin",
+		Headers: map[string][]string{
+			"traceparent": {"00-f68de45b0b36ac1c97c2a43166c9cb8f-9a94fd01ca53f63d-01"},
+		},
+	})
+	chk.NoError(err)
+	env.Failing["kong.ip.is_trusted"] = true
+
+	conf := newTestPlugin()
+	conf.opts.trust = trustPolicy{TrustedIPs: true}
+	env.DoHttp(conf)
+
+	if chk.Len(*exporter.spans, 5) {
+		serverSpan := (*exporter.spans)[4]
+		chk.False(serverSpan.Parent().IsValid(), "not trusted if Kong can't say")
+		chk.Equal([]string{"kong.ip.is_trusted"}, pdkMethods(serverSpan))
+	}
+}
@@ -13,123 +13,182 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
+
+	"goplugin/kongotel"
 
 	"github.com/Kong/go-pdk"
-	"github.com/Kong/go-pdk/server"
-	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	pluginName    = "goplugin"
-	pluginVersion = "0.1.0"
+	pluginName     = "goplugin"
+	pluginVersion  = "0.1.0"
+	pluginPriority = 0
+
+	// drainTimeout bounds how long shutdown waits for requests in flight
+	drainTimeout = 10 * time.Second
+	// flushTimeout bounds how long shutdown spends exporting telemetry
+	flushTimeout = 5 * time.Second
 )
 
 type Config struct {
 	Message string `json:"message"`
 	Timeout int    `json:"timeout_ms"`
-
-	// Hide context in the config
-	baseContext context.Context
 }
 
-func mkNew(ctx context.Context) func() interface{} {
-	New := func() interface{} {
-		return &Config{
-			baseContext: ctx,
-		}
-	}
-	return New
+func New() interface{} {
+	return &Config{}
 }
 
 func (conf Config) Access(kong *pdk.PDK) {
+	ctx := kongotel.Context(kong)
+	span := trace.SpanFromContext(ctx)
 
-	ctx, span, err := startAccessSpan(conf.baseContext, kong)
-	if err != nil {
-		_ = kong.Log.Err(err.Error())
-		kong.Response.ExitStatus(500)
-		return
-	}
-	defer span.End()
-
-	_, childSpan := getTracer(span).Start(ctx, "Get Host")
 	host, err := kong.Request.GetHeader("Host")
-	childSpan.End()
-	childSpan = nil
 	if err != nil {
-		_ = kong.Log.Err(err.Error())
+		kongotel.RecordPDKError(span, "kong.request.get_header", err)
+		kongotel.LogError(ctx, kong, err)
 	}
 	message := conf.Message
 	if message == "" {
 		message = "hello"
 	}
-	_, childSpan = getTracer(span).Start(ctx, "Set header")
-	err = kong.Response.SetHeader("x-hello-from-go", fmt.Sprintf("Go says %s to %s", message, host))
-	childSpan.End()
-	childSpan = nil
+	hello := fmt.Sprintf("Go says %s to %s", message, host)
+	if traceResponse, ok := kongotel.TraceResponse(ctx); ok {
+		hello += fmt.Sprintf(" (trace %s)", traceResponse)
+	}
+	err = kong.Response.SetHeader("x-hello-from-go", hello)
 	if err != nil {
-		_ = kong.Log.Err(err.Error())
+		kongotel.RecordPDKError(span, "kong.response.set_header", err)
+		kongotel.LogError(ctx, kong, err)
 	}
 
-	_, childSpan = getTracer(span).Start(ctx, "Exit 200")
 	kong.Response.ExitStatus(200)
-	childSpan.End()
-	childSpan = nil
-	// todo: think of a nice way to do this always
-	span.SetAttributes(semconv.HTTPResponseStatusCode(200))
 }
 
+// The plugin server's commands. Kong runs it with -dump to learn about
+// the plugin, and with no command at all to serve it.
+const (
+	cmdServe   = "serve"
+	cmdDump    = "dump"
+	cmdVersion = "version"
+)
+
 var (
-	instrument = flag.Bool("instrument", false, "run the otel instrumented server")
+	instrument = flag.Bool("instrument", true,
+		"export telemetry as configured by the plugin's otel record, unless it has sdk_disabled; false turns it off whatever the config")
+	printVersion = flag.Bool("version", false, "print the plugin's version, like the version command")
 )
 
 func main() {
-	flag.Parse()
-	if *instrument {
-		if err := run(); err != nil {
-			log.Fatalln(err)
-		}
+	flag.Usage = usage
+	// The command line exits on a bad flag
+	args, _ := parseArgs(flag.CommandLine, os.Args[1:])
+	// -dump and -help are go-pdk's
+	if flag.Lookup("help").Value.String() == "true" {
+		flag.Usage()
+		return
+	}
+	cmd, err := command(args, flag.Lookup("dump").Value.String() == "true", *printVersion)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(cmd); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [%s|%s|%s]\n\n", os.Args[0], cmdServe, cmdDump, cmdVersion)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s serves the plugin to Kong by default.\n\nFlags:\n", pluginName)
+	flag.PrintDefaults()
+}
+
+// parseArgs parses the flags on either side of the command, so that both
+// "-kong-prefix /kong serve" and "serve -kong-prefix /kong" work. It
+// returns the command and anything after it.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() == 0 {
+		return nil, nil
+	}
+	cmd := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return nil, err
+	}
+	return append([]string{cmd}, fs.Args()...), nil
+}
+
+// command is the command to run, given the arguments after the flags.
+// The -dump and -version flags stand for their commands.
+func command(args []string, dump, version bool) (string, error) {
+	switch {
+	case dump:
+		return cmdDump, nil
+	case version:
+		return cmdVersion, nil
+	case len(args) == 0:
+		return cmdServe, nil
+	case len(args) > 1:
+		return "", fmt.Errorf("unexpected arguments after %s: %s", args[0], strings.Join(args[1:], " "))
 	}
-	// probably -dump or -help
-	_ = enterPDK(context.Background())
+	switch args[0] {
+	case cmdServe, cmdDump, cmdVersion:
+		return args[0], nil
+	}
+	return "", fmt.Errorf("unknown command %q", args[0])
 }
 
-func enterPDK(ctx context.Context) error {
-	return server.StartServer(mkNew(ctx), pluginVersion, 0)
+func run(cmd string) error {
+	switch cmd {
+	case cmdDump:
+		return kongotel.Dump(New, pluginVersion, pluginPriority)
+	case cmdVersion:
+		fmt.Println(pluginName, pluginVersion)
+		return nil
+	}
+	return serve(*instrument)
 }
 
-func run() (err error) {
+// serve runs the plugin server until the process is told to stop, then
+// shuts down the telemetry of the requests it served.
+func serve(instrumented bool) (err error) {
 	// Handle SIGINT (CTRL+C) gracefully.
 	ctx, stop := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM,
 	)
 	defer stop()
 
-	// Set up OpenTelemetry.
-	otelShutdown, err := setupOTelSDK(ctx)
-	if err != nil {
-		return
+	// Set up OpenTelemetry, once the first plugin instance gives us
+	// its configuration. Without it, the global no-op providers are used.
+	var otelSDK *kongotel.Telemetry
+	if instrumented {
+		otelSDK = kongotel.NewTelemetry(ctx, pluginName, pluginVersion)
 	}
-	// Handle shutdown properly so nothing leaks.
+	// Handle shutdown properly so nothing leaks: let the requests in
+	// flight finish, then export their telemetry.
 	defer func() {
-		err = errors.Join(err, otelShutdown(context.Background()))
-	}()
-
-	// Start Plugin server.
-	srvErr := make(chan error, 1)
-	go func() {
-		srvErr <- enterPDK(ctx)
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := otelSDK.Drain(drainCtx); err != nil {
+			log.Printf("waiting for requests in flight: %s", err)
+		}
+		flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		err = errors.Join(err, otelSDK.Shutdown(flushCtx))
 	}()
 
-	// Wait for interruption.
-	select {
-	case err = <-srvErr:
-		// Error when starting Plugin server.
-		return
-	case <-ctx.Done():
-		// Wait for first CTRL+C.
-		// Stop receiving signal notifications as soon as possible.
-		stop()
-	}
+	// Serve the plugin until interrupted, when Kong stops being able to
+	// connect for new plugin instances, before the drain above.
+	err = kongotel.StartServer(ctx, otelSDK, New, pluginVersion, pluginPriority)
+	// Stop receiving signal notifications as soon as possible.
+	stop()
 	return
 }
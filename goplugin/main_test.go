@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"testing"
+
+	"goplugin/kongotel"
+	"goplugin/test"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestPlugin(t *testing.T) {
+	chk := assert.New(t)
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin?q=search&x=9",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	New := kongotel.NewPlugin(context.Background(), nil, New)
+
+	env.DoHttp(New())
+	chk.False(env.IsRunning(), "the plugin answers without proxying")
+	chk.Equal(200, env.ClientRes.Status)
+	chk.Equal("Go says hello to localhost", env.ClientRes.Headers.Get("x-hello-from-go"))
+}
+
+// TestPlugin_Traced checks that the request is still traced to the end
+// after the plugin exits in Access: Kong runs the log phase regardless.
+func TestPlugin_Traced(t *testing.T) {
+	chk := assert.New(t)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		_ = tp.Shutdown(context.Background())
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	New := kongotel.NewPlugin(context.Background(), nil, New)
+	env.DoHttp(New())
+
+	names := []string{}
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+	}
+	chk.Contains(names, "Log")
+	spans := recorder.Ended()
+	if chk.NotEmpty(spans) {
+		serverSpan := spans[len(spans)-1]
+		chk.Contains(serverSpan.Attributes(), semconv.HTTPResponseStatusCode(200))
+	}
+}
+
+func TestPlugin_TraceResponse(t *testing.T) {
+	chk := assert.New(t)
+	tp := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		_ = tp.Shutdown(context.Background())
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	env, err := test.New(t, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/plugin",
+		Headers: map[string][]string{"host": {"localhost"}},
+	})
+	chk.NoError(err)
+
+	New := kongotel.NewPlugin(context.Background(), nil, New)
+	conf := New()
+	chk.NoError(json.Unmarshal([]byte(`{"otel": {"trace_response_header": "X-Trace-Id"}}`), conf))
+
+	env.DoHttp(conf)
+	traceID := env.ClientRes.Headers.Get("X-Trace-Id")
+	chk.Regexp(`^[0-9a-f]{32};sampled=1$`, traceID)
+	chk.Equal("Go says hello to localhost (trace "+traceID+")", env.ClientRes.Headers.Get("x-hello-from-go"))
+}
+
+func TestCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		cmd     string
+		prefix  string
+		wantErr bool
+	}{
+		// What Kong runs
+		{args: []string{"-instrument", "-kong-prefix", "/kong"}, cmd: cmdServe, prefix: "/kong"},
+		{args: []string{"-dump"}, cmd: cmdDump},
+		{args: []string{"serve", "-kong-prefix", "/kong"}, cmd: cmdServe, prefix: "/kong"},
+		{args: []string{"-kong-prefix", "/kong", "dump"}, cmd: cmdDump, prefix: "/kong"},
+		{args: []string{"version"}, cmd: cmdVersion},
+		{args: []string{"-version"}, cmd: cmdVersion},
+		{args: []string{"bogus"}, wantErr: true},
+		{args: []string{"serve", "dump"}, wantErr: true},
+	} {
+		fs := flag.NewFlagSet("goplugin", flag.ContinueOnError)
+		fs.Bool("instrument", true, "")
+		dump := fs.Bool("dump", false, "")
+		version := fs.Bool("version", false, "")
+		prefix := fs.String("kong-prefix", "", "")
+
+		args, err := parseArgs(fs, tc.args)
+		if !assert.NoError(t, err, tc.args) {
+			continue
+		}
+		cmd, err := command(args, *dump, *version)
+		if tc.wantErr {
+			assert.Error(t, err, tc.args)
+			continue
+		}
+		assert.Equal(t, tc.cmd, cmd, tc.args)
+		assert.Equal(t, tc.prefix, *prefix, tc.args)
+	}
+}
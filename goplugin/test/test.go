@@ -192,6 +192,15 @@ type TestEnv struct {
 	ServiceReq  Request
 	ServiceRes  Response
 	ClientRes   Response
+	Shared      map[string]interface{}
+	// Failing PDK methods return an error, e.g. "kong.request.get_path"
+	Failing map[string]bool
+	// Route and Service are what the router matched. A nil Route is a
+	// request that hasn't been routed, as in the rewrite phase.
+	Route   *kong_plugin_protocol.Route
+	Service *kong_plugin_protocol.Service
+	// TrustedIPs are those kong.ip.is_trusted says yes to. If nil, all are
+	TrustedIPs []string
 }
 
 // New creates a new test environment.
@@ -208,10 +217,30 @@ func New(t *testing.T, req Request) (env *TestEnv, err error) {
 		ServiceReq: req.clone(),
 		ServiceRes: Response{Headers: make(http.Header)},
 		ClientRes:  Response{Headers: make(http.Header)},
+		Shared:     make(map[string]interface{}),
+		Failing:    make(map[string]bool),
+		Route: &kong_plugin_protocol.Route{
+			Id:        "001:002",
+			Name:      "route_66",
+			Protocols: []string{"http", "tcp"},
+			Paths:     []string{"/v0/left", "/v1/this"},
+		},
+		Service: &kong_plugin_protocol.Service{
+			Id:       "003:004",
+			Name:     "self_service",
+			Protocol: "http",
+			Path:     "/v0/left",
+		},
 	}
 
-	b := bridge.New(bridgetest.MockFunc(env)) // check
-	env.pdk = &pdk.PDK{
+	env.pdk = env.newPDK()
+	return
+}
+
+// newPDK returns a PDK whose calls go to the test environment.
+func (e *TestEnv) newPDK() *pdk.PDK {
+	b := bridge.New(bridgetest.MockFunc(e)) // check
+	return &pdk.PDK{
 		Client:          client.Client{PdkBridge: b},
 		Ctx:             ctx.Ctx{PdkBridge: b},
 		Log:             log.Log{PdkBridge: b},
@@ -225,7 +254,6 @@ func New(t *testing.T, req Request) (env *TestEnv, err error) {
 		ServiceRequest:  service_request.Request{PdkBridge: b},
 		ServiceResponse: service_response.Response{PdkBridge: b},
 	}
-	return
 }
 
 func (e *TestEnv) noErr(err error) {
@@ -259,6 +287,11 @@ func (e *TestEnv) Handle(method string, args_d []byte) []byte {
 	var out proto.Message
 	var err error
 
+	if e.Failing[method] {
+		// A truncated varint, which the PDK fails to unmarshal
+		return []byte{0xff}
+	}
+
 	switch method {
 
 	case "kong.client.get_ip", "kong.client.get_forwarded_ip":
@@ -279,8 +312,24 @@ func (e *TestEnv) Handle(method string, args_d []byte) []byte {
 	case "kong.client.get_protocol":
 		out = bridge.WrapString("https")
 
+	case "kong.ctx.shared.set":
+		args := kong_plugin_protocol.KV{}
+		e.noErr(proto.Unmarshal(args_d, &args))
+		e.Shared[args.K] = args.V.AsInterface()
+
+	case "kong.ctx.shared.get":
+		args := kong_plugin_protocol.String{}
+		e.noErr(proto.Unmarshal(args_d, &args))
+		out, err = structpb.NewValue(e.Shared[args.V])
+
 	case "kong.ip.is_trusted":
-		out = &kong_plugin_protocol.Bool{V: true}
+		args := kong_plugin_protocol.String{}
+		e.noErr(proto.Unmarshal(args_d, &args))
+		trusted := e.TrustedIPs == nil
+		for _, ip := range e.TrustedIPs {
+			trusted = trusted || ip == args.V
+		}
+		out = &kong_plugin_protocol.Bool{V: trusted}
 
 	case "kong.log.alert", "kong.log.crit", "kong.log.err", "kong.log.warn",
 		"kong.log.notice", "kong.log.info", "kong.log.debug":
@@ -453,19 +502,15 @@ func (e *TestEnv) Handle(method string, args_d []byte) []byte {
 		e.ClientRes.Body = args.Body
 
 	case "kong.router.get_route":
-		out = &kong_plugin_protocol.Route{
-			Id:        "001:002",
-			Name:      "route_66",
-			Protocols: []string{"http", "tcp"},
-			Paths:     []string{"/v0/left", "/v1/this"},
+		out = &kong_plugin_protocol.Route{}
+		if e.Route != nil {
+			out = e.Route
 		}
 
 	case "kong.router.get_service":
-		out = &kong_plugin_protocol.Service{
-			Id:       "003:004",
-			Name:     "self_service",
-			Protocol: "http",
-			Path:     "/v0/left",
+		out = &kong_plugin_protocol.Service{}
+		if e.Service != nil {
+			out = e.Service
 		}
 
 	case "kong.service.set_upstream", "kong.service.set_target":
@@ -630,9 +675,13 @@ func (e *TestEnv) DoPreread(config interface{}) {
 
 // DoLog tests the Log method of the plugin
 // with the plugin configuration passed in the argument.
+// As in Kong, it runs even if an earlier phase exited, on a PDK of its
+// own, as exiting closes the PDK it was called on.
 func (e *TestEnv) DoLog(config interface{}) {
 	if !e.IsRunning() {
-		return
+		e.pdk = e.newPDK()
+		e.state = running
+		defer func() { e.state = finished }()
 	}
 	if h, ok := config.(interface{ Log(*pdk.PDK) }); ok {
 		e.t.Log("Log")